@@ -0,0 +1,44 @@
+package bytestorage
+
+// Append appends data to the value of the given key k.
+//
+// The value grows in place while its memory has spare capacity,
+// so accumulating small records per key doesn't copy the whole value
+// on every call. Missing key is stored with data as its value.
+// The expiration deadline of an existing entry is kept.
+//
+// Appended entries aren't passed to OnRemove, since the previous
+// value stays the prefix of the new one.
+func (s *Storage) Append(k, data []byte) {
+	h := s.hasher.Hash(k)
+	idx := h & s.mask
+	s.buckets[idx].append(k, data, h)
+}
+
+func (b *bucket) append(k, data []byte, h uint64) {
+	b.lock()
+	idx, found := b.find(k, h)
+	if !found || b.expired(idx) {
+		b.putLocked(k, data, h, 0)
+		b.unlock()
+		return
+	}
+	b.setCalls.Add(1)
+	b.ev.record(h)
+	b.ev.touch(idx)
+	// Snapshots reference only the first len(v) bytes,
+	// so spare capacity may be used even if they exist.
+	c := cap(b.kv[idx][1])
+	b.kv[idx][1] = append(b.kv[idx][1], data...)
+	b.allocated.Add(uint64(cap(b.kv[idx][1])) - uint64(c))
+	b.size.Add(uint64(len(data)))
+	if b.ev.limited() {
+		b.evict(idx)
+	}
+	if b.wal != nil {
+		// The whole value is logged, since replaying an append
+		// of an entry already saved by checkpoint duplicates data.
+		b.wal.append(walSet, h, b.slots[idx].expire, k, b.kv[idx][1])
+	}
+	b.unlock()
+}
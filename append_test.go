@@ -0,0 +1,207 @@
+package bytestorage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStorageAppend(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	s.Append(k, []byte("foo"))
+	s.Append(k, []byte("bar"))
+	if v := s.Get(nil, k); string(v) != "foobar" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "foobar")
+	}
+	if size := s.Size(); size != 9 {
+		t.Fatalf("unexpected size; got %d; want %d", size, 9)
+	}
+
+	// Spare capacity is used in place.
+	b := &s.buckets[s.hasher.Hash(k)&s.mask]
+	idx, _ := b.find(k, s.hasher.Hash(k))
+	b.allocated.Add(64 - uint64(cap(b.kv[idx][1])))
+	b.kv[idx][1] = append(make([]byte, 0, 64), b.kv[idx][1]...)
+	p := &b.kv[idx][1][:1][0]
+	for i := 0; i < 10; i++ {
+		s.Append(k, []byte(fmt.Sprintf("%d", i)))
+	}
+	if &b.kv[idx][1][0] != p {
+		t.Fatalf("value must grow in place")
+	}
+	if v := s.Get(nil, k); string(v) != "foobar0123456789" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "foobar0123456789")
+	}
+	if size := s.Size(); size != 19 {
+		t.Fatalf("unexpected size; got %d; want %d", size, 19)
+	}
+
+	// Snapshot sees the value it was taken with.
+	entries := b.snapshot(nil)
+	s.Append(k, []byte("baz"))
+	for _, e := range entries {
+		if string(e.k) == "key" && string(e.v) != "foobar0123456789" {
+			t.Fatalf("unexpected snapshot value; got %q; want %q", e.v, "foobar0123456789")
+		}
+	}
+	b.releaseSnapshot()
+
+	// Keys sharing the same hash are told apart.
+	s.colSet([]byte("aaa"), []byte("bbb"), brokenHash)
+	s.colSet([]byte("bbb"), []byte("ccc"), brokenHash)
+	s.buckets[brokenHash&s.mask].append([]byte("bbb"), []byte("ddd"), brokenHash)
+	if v := s.colGet(nil, []byte("aaa"), brokenHash); string(v) != "bbb" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "bbb")
+	}
+	if v := s.colGet(nil, []byte("bbb"), brokenHash); string(v) != "cccddd" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "cccddd")
+	}
+	checkBuckets(t, s)
+}
+
+func TestStorageAppendTTL(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	s.SetWithTTL(k, []byte("foo"), time.Hour)
+	s.Append(k, []byte("bar"))
+	if ttl, ok := s.TTL(k); !ok || ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("expiration deadline must be kept; got %s, %v", ttl, ok)
+	}
+
+	// Expired value is replaced.
+	s.SetWithTTL(k, []byte("foo"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	s.Append(k, []byte("bar"))
+	if v := s.Get(nil, k); string(v) != "bar" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "bar")
+	}
+	if ttl, ok := s.TTL(k); !ok || ttl != 0 {
+		t.Fatalf("unexpected ttl; got %s, %v; want %s, %v", ttl, ok, time.Duration(0), true)
+	}
+	checkBuckets(t, s)
+}
+
+func TestStorageAppendBounded(t *testing.T) {
+	s := NewBounded(Limits{MaxBytes: 100 * bucketsCount})
+	defer s.Reset()
+
+	keys := keysForBucket(s, 0, 3)
+	for _, k := range keys {
+		s.Set(k, make([]byte, 25))
+	}
+	if n := s.buckets[0].getEntriesCount(); n != 3 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, 3)
+	}
+	// Growing the last key evicts the least recently used one.
+	s.Append(keys[2], make([]byte, 25))
+	if s.Has(keys[0]) {
+		t.Fatalf("key %q must be evicted", keys[0])
+	}
+	if v := s.Get(nil, keys[2]); len(v) != 50 {
+		t.Fatalf("unexpected value length; got %d; want %d", len(v), 50)
+	}
+	checkBuckets(t, s)
+}
+
+func TestStorageAppendWAL(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	w, err := OpenWAL(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	s := New()
+	s.AttachWAL(w)
+	for i := 0; i < 100; i++ {
+		s.Append([]byte(fmt.Sprintf("key %d", i%10)), []byte(fmt.Sprintf("%d,", i)))
+	}
+	s.AttachWAL(nil)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	w, err = OpenWAL(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	defer w.Close()
+	s1 := New()
+	if err := w.Replay(s1); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if v, v1 := s.Get(nil, k), s1.Get(nil, k); string(v) != string(v1) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v1, v)
+		}
+	}
+}
+
+func TestStorageAppendCheckpoint(t *testing.T) {
+	tmpDir := t.TempDir()
+	walDir := filepath.Join(tmpDir, "wal")
+	filePath := filepath.Join(tmpDir, "data.bytestorage")
+	w, err := OpenWAL(walDir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	s := New()
+	s.AttachWAL(w)
+
+	// Appends racing with checkpoint are both saved to file and kept in log.
+	startCh := make(chan struct{})
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			s.Append([]byte(fmt.Sprintf("key %d", i%64)), []byte(fmt.Sprintf("%d,", i)))
+			if i == 1000 {
+				close(startCh)
+			}
+		}
+	}()
+	<-startCh
+	for i := 0; i < 10; i++ {
+		if err := w.Checkpoint(s, filePath); err != nil {
+			t.Fatalf("Checkpoint error: %s", err)
+		}
+	}
+	close(stopCh)
+	wg.Wait()
+	s.AttachWAL(nil)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	s1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	w, err = OpenWAL(walDir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	defer w.Close()
+	if err := w.Replay(s1); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+	for i := 0; i < 64; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if v, v1 := s.Get(nil, k), s1.Get(nil, k); string(v) != string(v1) {
+			t.Fatalf("unexpected value for key %q; got %d bytes; want %d bytes", k, len(v1), len(v))
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package bytestorage
+
+import (
+	"slices"
+	"sync"
+)
+
+// SetMany stores (keys[i], values[i]) pairs in the storage.
+//
+// Keys are grouped by bucket, so every bucket lock is taken once
+// per call. SetMany panics if len(keys) != len(values).
+func (s *Storage) SetMany(keys, values [][]byte) {
+	if len(keys) != len(values) {
+		panic("BUG: len(keys) must be equal to len(values)")
+	}
+	bt := s.newBatch(keys)
+	bt.forEachBucket(func(b *bucket, lo, hi int) {
+		b.lock()
+		for _, o := range bt.order[lo:hi] {
+			i := uint32(o)
+			b.putLocked(keys[i], values[i], bt.hs[i], 0)
+		}
+		b.unlock()
+	})
+	putBatch(bt)
+}
+
+// GetMany appends values for the given keys to dst and returns the result.
+//
+// The value for keys[i] is appended to dst[i], so buffers of dst may be
+// re-used between calls, like with Get. dst is extended to len(keys)
+// if needed. Values for missing keys are empty.
+//
+// Keys are grouped by bucket, so every bucket lock is taken once per call.
+func (s *Storage) GetMany(dst, keys [][]byte) [][]byte {
+	if n := len(keys) - len(dst); n > 0 {
+		dst = append(dst, make([][]byte, n)...)
+	}
+	dst = dst[:len(keys)]
+	bt := s.newBatch(keys)
+	bt.forEachBucket(func(b *bucket, lo, hi int) {
+		b.rlock()
+		for _, o := range bt.order[lo:hi] {
+			i := uint32(o)
+			dst[i], _ = b.getLocked(dst[i][:0], keys[i], bt.hs[i])
+		}
+		b.mu.RUnlock()
+	})
+	putBatch(bt)
+	return dst
+}
+
+// DelMany deletes the given keys from the storage.
+//
+// Keys are grouped by bucket, so every bucket lock is taken once per call.
+func (s *Storage) DelMany(keys [][]byte) {
+	bt := s.newBatch(keys)
+	bt.forEachBucket(func(b *bucket, lo, hi int) {
+		b.lock()
+		for _, o := range bt.order[lo:hi] {
+			i := uint32(o)
+			b.delLocked(keys[i], bt.hs[i])
+		}
+		b.unlock()
+	})
+	putBatch(bt)
+}
+
+// batch holds key hashes and key indexes ordered by bucket.
+type batch struct {
+	s *Storage
+
+	// hs[i] is the hash of keys[i].
+	hs []uint64
+
+	// order contains bucket<<32 | i for every keys[i] in ascending order.
+	// So keys of the same bucket keep the input order, and writes
+	// of the same key are applied in the order they are passed.
+	order []uint64
+}
+
+var batchPool sync.Pool
+
+func (s *Storage) newBatch(keys [][]byte) *batch {
+	bt, _ := batchPool.Get().(*batch)
+	if bt == nil {
+		bt = &batch{}
+	}
+	bt.s = s
+	bt.hs = slices.Grow(bt.hs[:0], len(keys))
+	bt.order = slices.Grow(bt.order[:0], len(keys))
+	for i, k := range keys {
+		h := s.hasher.Hash(k)
+		bt.hs = append(bt.hs, h)
+		bt.order = append(bt.order, (h&s.mask)<<32|uint64(i))
+	}
+	slices.Sort(bt.order)
+	return bt
+}
+
+func putBatch(bt *batch) {
+	bt.s = nil
+	batchPool.Put(bt)
+}
+
+// forEachBucket calls f for every bucket with keys from bt.order[lo:hi].
+func (bt *batch) forEachBucket(f func(b *bucket, lo, hi int)) {
+	for lo := 0; lo < len(bt.order); {
+		idx := bt.order[lo] >> 32
+		hi := lo + 1
+		for hi < len(bt.order) && bt.order[hi]>>32 == idx {
+			hi++
+		}
+		f(&bt.s.buckets[idx], lo, hi)
+		lo = hi
+	}
+}
@@ -0,0 +1,109 @@
+package bytestorage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestStorageSetGetDelMany(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	const itemsCount = 1000
+	var keys, values [][]byte
+	for i := 0; i < itemsCount; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key %d", i)))
+		values = append(values, []byte(fmt.Sprintf("value %d", i)))
+	}
+	// The last write of the same key wins.
+	keys = append(keys, keys[0])
+	values = append(values, []byte("last"))
+	s.SetMany(keys, values)
+	if n := s.EntriesCount(); n != itemsCount {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, itemsCount)
+	}
+
+	// Missing keys get empty values, buffers of dst are re-used.
+	dst := [][]byte{make([]byte, 0, 64)}
+	buf := dst[0]
+	dst = s.GetMany(dst, append(keys, []byte("missing")))
+	if len(dst) != itemsCount+2 {
+		t.Fatalf("unexpected number of values; got %d; want %d", len(dst), itemsCount+2)
+	}
+	if &dst[0][:1][0] != &buf[:1][0] {
+		t.Fatalf("dst[0] buffer must be re-used")
+	}
+	for i := 1; i < itemsCount; i++ {
+		if string(dst[i]) != string(values[i]) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", keys[i], dst[i], values[i])
+		}
+	}
+	if string(dst[0]) != "last" || string(dst[itemsCount]) != "last" {
+		t.Fatalf("unexpected value for key %q; got %q, %q; want %q", keys[0], dst[0], dst[itemsCount], "last")
+	}
+	if len(dst[itemsCount+1]) != 0 {
+		t.Fatalf("unexpected value for missing key; got %q", dst[itemsCount+1])
+	}
+
+	// dst longer than keys is truncated.
+	dst = s.GetMany(dst, keys[1:3])
+	if len(dst) != 2 || string(dst[0]) != string(values[1]) || string(dst[1]) != string(values[2]) {
+		t.Fatalf("unexpected values; got %q; want %q", dst, values[1:3])
+	}
+
+	var deleted [][]byte
+	for i := 0; i < itemsCount; i += 2 {
+		deleted = append(deleted, keys[i])
+	}
+	s.DelMany(deleted)
+	for i := 0; i < itemsCount; i++ {
+		if s.Has(keys[i]) != (i%2 != 0) {
+			t.Fatalf("unexpected existence of key %q; got %v; want %v", keys[i], s.Has(keys[i]), i%2 != 0)
+		}
+	}
+	if n := s.EntriesCount(); n != itemsCount/2 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, itemsCount/2)
+	}
+	checkBuckets(t, s)
+}
+
+func TestStorageSetManyPanic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expecting panic on different lengths of keys and values")
+		}
+	}()
+	New().SetMany([][]byte{[]byte("key")}, nil)
+}
+
+func TestStorageManyConcurrent(t *testing.T) {
+	s := NewBounded(Limits{MaxEntries: 4 * bucketsCount})
+	defer s.Reset()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			var keys, dst [][]byte
+			for j := 0; j < 100; j++ {
+				keys = keys[:0]
+				for k := 0; k < 50; k++ {
+					keys = append(keys, []byte(fmt.Sprintf("key %d", (j*50+k+n)%3000)))
+				}
+				s.SetMany(keys, keys)
+				dst = s.GetMany(dst, keys)
+				for k, v := range dst {
+					if len(v) != 0 && string(v) != string(keys[k]) {
+						t.Errorf("unexpected value for key %q; got %q", keys[k], v)
+						return
+					}
+				}
+				s.DelMany(keys[:10])
+			}
+		}(i)
+	}
+	wg.Wait()
+	checkBuckets(t, s)
+}
@@ -0,0 +1,111 @@
+package bytestorage
+
+import (
+	"encoding/binary"
+
+	"github.com/zeebo/xxh3"
+)
+
+// Maximum length of a value chunk stored by SetBig.
+const maxChunkLen = 64 * 1024
+
+// Length of the metadata stored by SetBig under the key:
+// xxh3 checksum of the value and its length.
+const bigMetaLen = 16
+
+// SetBig stores (k, v) in the storage, where v may exceed 64KB.
+//
+// v is split into 64KB chunks stored as separate entries, so big values
+// are spread over buckets without huge contiguous allocations.
+// The key entry holds the value checksum and length, so values with
+// missing or overwritten chunks aren't returned by GetBig.
+//
+// Values stored with SetBig must be read with GetBig and deleted with DelBig.
+// Concurrent SetBig calls for the same key may leave chunks of
+// the replaced value in the storage.
+func (s *Storage) SetBig(k, v []byte) {
+	sum := xxh3.Hash(v)
+	var old [bigMetaLen]byte
+	meta, exists := s.HasGet(old[:0], k)
+
+	var buf []byte
+	for i := 0; i*maxChunkLen < len(v) || i == 0; i++ {
+		chunk := v[i*maxChunkLen:]
+		if len(chunk) > maxChunkLen {
+			chunk = chunk[:maxChunkLen]
+		}
+		buf = appendChunkKey(buf[:0], k, sum, uint64(i))
+		s.Set(buf, chunk)
+	}
+	var m [bigMetaLen]byte
+	binary.BigEndian.PutUint64(m[:], sum)
+	binary.BigEndian.PutUint64(m[8:], uint64(len(v)))
+	s.Set(k, m[:])
+
+	// Chunks of the replaced value aren't reachable anymore.
+	if exists && len(meta) == bigMetaLen && binary.BigEndian.Uint64(meta) != sum {
+		s.delChunks(buf, k, meta)
+	}
+}
+
+// GetBig appends the value stored by SetBig for the given key k to dst
+// and returns the result.
+//
+// dst is returned unchanged if k is missing, if it wasn't stored by SetBig
+// or if any chunk of the value is missing or corrupted.
+func (s *Storage) GetBig(dst, k []byte) []byte {
+	var m [bigMetaLen]byte
+	meta, exists := s.HasGet(m[:0], k)
+	if !exists || len(meta) != bigMetaLen {
+		return dst
+	}
+	sum := binary.BigEndian.Uint64(meta)
+	valueLen := binary.BigEndian.Uint64(meta[8:])
+
+	start := len(dst)
+	var buf []byte
+	for i := uint64(0); i == 0 || i*maxChunkLen < valueLen; i++ {
+		buf = appendChunkKey(buf[:0], k, sum, i)
+		var found bool
+		dst, found = s.HasGet(dst, buf)
+		if !found || uint64(len(dst)-start) > valueLen {
+			return dst[:start]
+		}
+	}
+	v := dst[start:]
+	if uint64(len(v)) != valueLen || xxh3.Hash(v) != sum {
+		return dst[:start]
+	}
+	return dst
+}
+
+// DelBig deletes the value stored by SetBig for the given key k.
+func (s *Storage) DelBig(k []byte) {
+	var m [bigMetaLen]byte
+	meta, exists := s.HasGet(m[:0], k)
+	s.Del(k)
+	if exists && len(meta) == bigMetaLen {
+		s.delChunks(nil, k, meta)
+	}
+}
+
+// delChunks deletes chunks of the value with the given metadata.
+func (s *Storage) delChunks(buf, k, meta []byte) {
+	sum := binary.BigEndian.Uint64(meta)
+	valueLen := binary.BigEndian.Uint64(meta[8:])
+	for i := uint64(0); i == 0 || i*maxChunkLen < valueLen; i++ {
+		buf = appendChunkKey(buf[:0], k, sum, i)
+		s.Del(buf)
+	}
+}
+
+// appendChunkKey appends the key of the i-th chunk of the value
+// with the given checksum stored for k.
+//
+// The key contains k, so chunks of equal values stored for different
+// keys are deleted independently.
+func appendChunkKey(dst, k []byte, sum, i uint64) []byte {
+	dst = binary.BigEndian.AppendUint64(dst, sum)
+	dst = binary.BigEndian.AppendUint64(dst, i)
+	return append(dst, k...)
+}
@@ -0,0 +1,119 @@
+package bytestorage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/zeebo/xxh3"
+)
+
+func TestStorageSetGetBig(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	for _, n := range []int{0, 1, maxChunkLen - 1, maxChunkLen, maxChunkLen + 1, 1 << 20} {
+		k := []byte(fmt.Sprintf("key %d", n))
+		v := make([]byte, n)
+		for i := range v {
+			v[i] = byte(i * 7)
+		}
+		s.SetBig(k, v)
+		prefix := []byte("prefix")
+		got := s.GetBig(prefix, k)
+		if !bytes.Equal(got[:len(prefix)], prefix) || !bytes.Equal(got[len(prefix):], v) {
+			t.Fatalf("unexpected value for key %q; got %d bytes; want %d bytes", k, len(got)-len(prefix), n)
+		}
+
+		// The value is split into chunks.
+		chunks := (n + maxChunkLen - 1) / maxChunkLen
+		if chunks == 0 {
+			chunks = 1
+		}
+		for i := 0; i < chunks; i++ {
+			if chunk := s.Get(nil, appendChunkKey(nil, k, xxh3.Hash(v), uint64(i))); len(chunk) > maxChunkLen {
+				t.Fatalf("too big chunk %d; got %d bytes; want at most %d", i, len(chunk), maxChunkLen)
+			}
+		}
+		s.DelBig(k)
+		if got := s.GetBig(nil, k); len(got) != 0 {
+			t.Fatalf("unexpected value for deleted key %q; got %d bytes", k, len(got))
+		}
+		if n := s.EntriesCount(); n != 0 {
+			t.Fatalf("DelBig must delete all the chunks; got %d entries", n)
+		}
+	}
+
+	// Values stored with Set aren't returned.
+	s.Set([]byte("small"), []byte("value"))
+	s.Set([]byte("small16"), []byte("0123456789abcdef"))
+	for _, k := range []string{"small", "small16", "missing"} {
+		if got := s.GetBig([]byte("dst"), []byte(k)); string(got) != "dst" {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, got, "dst")
+		}
+	}
+	checkBuckets(t, s)
+}
+
+func TestStorageBigReplace(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	s.SetBig(k, bytes.Repeat([]byte("a"), 3*maxChunkLen))
+	s.SetBig(k, bytes.Repeat([]byte("b"), maxChunkLen+1))
+	if got := s.GetBig(nil, k); !bytes.Equal(got, bytes.Repeat([]byte("b"), maxChunkLen+1)) {
+		t.Fatalf("unexpected value; got %d bytes; want %d bytes", len(got), maxChunkLen+1)
+	}
+	// Chunks of the replaced value are deleted.
+	if n := s.EntriesCount(); n != 3 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, 3)
+	}
+
+	// Equal values of different keys don't share chunks.
+	v := bytes.Repeat([]byte("c"), 2*maxChunkLen)
+	s.SetBig([]byte("key 1"), v)
+	s.SetBig([]byte("key 2"), v)
+	s.DelBig([]byte("key 1"))
+	if got := s.GetBig(nil, []byte("key 2")); !bytes.Equal(got, v) {
+		t.Fatalf("unexpected value; got %d bytes; want %d bytes", len(got), len(v))
+	}
+}
+
+func TestStorageBigCorrupted(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	v := bytes.Repeat([]byte("abcd"), maxChunkLen)
+	sum := xxh3.Hash(v)
+
+	// Overwritten chunk.
+	s.SetBig(k, v)
+	s.Set(appendChunkKey(nil, k, sum, 1), bytes.Repeat([]byte("x"), maxChunkLen))
+	if got := s.GetBig([]byte("dst"), k); string(got) != "dst" {
+		t.Fatalf("corrupted value must not be returned; got %d bytes", len(got))
+	}
+
+	// Truncated chunk.
+	s.SetBig(k, v)
+	s.Set(appendChunkKey(nil, k, sum, 2), []byte("abcd"))
+	if got := s.GetBig(nil, k); len(got) != 0 {
+		t.Fatalf("truncated value must not be returned; got %d bytes", len(got))
+	}
+
+	// Missing chunk.
+	s.SetBig(k, v)
+	s.Del(appendChunkKey(nil, k, sum, 3))
+	if got := s.GetBig(nil, k); len(got) != 0 {
+		t.Fatalf("partial value must not be returned; got %d bytes", len(got))
+	}
+
+	// Value of another key.
+	s.SetBig(k, v)
+	s.SetBig([]byte("other"), bytes.Repeat([]byte("x"), 10))
+	s.Set(k, s.Get(nil, []byte("other")))
+	if got := s.GetBig(nil, k); len(got) != 0 {
+		t.Fatalf("value with mismatched metadata must not be returned; got %d bytes", len(got))
+	}
+}
@@ -0,0 +1,19 @@
+package bytestorage
+
+// Cache is the method set shared by Storage and fastcache.Cache.
+//
+// Package fastcachecompat adapts fastcache.Cache to Cache and gives
+// Storage the fastcache.Cache method set, so this package doesn't
+// depend on fastcache.
+type Cache interface {
+	Set(k, v []byte)
+	Get(dst, k []byte) []byte
+	HasGet(dst, k []byte) ([]byte, bool)
+	Has(k []byte) bool
+	Del(k []byte)
+	Reset()
+	UpdateStats(s *Stats)
+	SaveToFile(filePath string) error
+}
+
+var _ Cache = (*Storage)(nil)
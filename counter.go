@@ -0,0 +1,89 @@
+package bytestorage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Byte length of counter values.
+const counterSize = 8
+
+// ErrInvalidCounter is returned by counter methods if the value
+// of the key isn't an 8-byte big-endian integer.
+var ErrInvalidCounter = errors.New("value isn't a valid counter")
+
+// ErrCounterOverflow is returned by IncrBy and DecrBy if the result
+// doesn't fit int64.
+var ErrCounterOverflow = errors.New("counter overflow")
+
+// IncrBy atomically adds delta to the counter stored for the given key k
+// and returns the result.
+//
+// Counters are stored as 8-byte big-endian values, so they may be set
+// with Set and read with Get too. Missing key is treated as zero counter.
+// The counter is left unchanged on error.
+func (s *Storage) IncrBy(k []byte, delta int64) (int64, error) {
+	return s.updateCounter(k, func(n int64) (int64, error) {
+		if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+			return n, fmt.Errorf("cannot add %d to %d: %w", delta, n, ErrCounterOverflow)
+		}
+		return n + delta, nil
+	})
+}
+
+// DecrBy atomically subtracts delta from the counter stored for
+// the given key k and returns the result.
+//
+// See IncrBy for details.
+func (s *Storage) DecrBy(k []byte, delta int64) (int64, error) {
+	return s.updateCounter(k, func(n int64) (int64, error) {
+		// delta isn't negated, since -math.MinInt64 overflows.
+		if delta < 0 && n > math.MaxInt64+delta || delta > 0 && n < math.MinInt64+delta {
+			return n, fmt.Errorf("cannot subtract %d from %d: %w", delta, n, ErrCounterOverflow)
+		}
+		return n - delta, nil
+	})
+}
+
+// updateCounter atomically replaces the counter stored for k
+// with the result of apply.
+func (s *Storage) updateCounter(k []byte, apply func(n int64) (int64, error)) (int64, error) {
+	var n int64
+	var err error
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		if exists {
+			n, err = parseCounter(old)
+			if err != nil {
+				return nil, OpKeep
+			}
+		}
+		n, err = apply(n)
+		if err != nil {
+			return nil, OpKeep
+		}
+		// The value is copied into the existing kv slot.
+		return binary.BigEndian.AppendUint64(nil, uint64(n)), OpSet
+	})
+	return n, err
+}
+
+// GetInt returns the counter stored for the given key k.
+//
+// Zero is returned for missing key. See IncrBy for details.
+func (s *Storage) GetInt(k []byte) (int64, error) {
+	var buf [counterSize]byte
+	v, exists := s.HasGet(buf[:0], k)
+	if !exists {
+		return 0, nil
+	}
+	return parseCounter(v)
+}
+
+func parseCounter(v []byte) (int64, error) {
+	if len(v) != counterSize {
+		return 0, fmt.Errorf("%w; got %d bytes; want %d", ErrInvalidCounter, len(v), counterSize)
+	}
+	return int64(binary.BigEndian.Uint64(v)), nil
+}
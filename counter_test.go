@@ -0,0 +1,110 @@
+package bytestorage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestStorageCounter(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("counter")
+	if n, err := s.GetInt(k); err != nil || n != 0 {
+		t.Fatalf("unexpected counter for missing key; got %d, %v; want %d, %v", n, err, 0, nil)
+	}
+	if n, err := s.IncrBy(k, 5); err != nil || n != 5 {
+		t.Fatalf("unexpected IncrBy result; got %d, %v; want %d, %v", n, err, 5, nil)
+	}
+	if n, err := s.DecrBy(k, 7); err != nil || n != -2 {
+		t.Fatalf("unexpected DecrBy result; got %d, %v; want %d, %v", n, err, -2, nil)
+	}
+	if n, err := s.GetInt(k); err != nil || n != -2 {
+		t.Fatalf("unexpected GetInt result; got %d, %v; want %d, %v", n, err, -2, nil)
+	}
+	if v := s.Get(nil, k); string(v) != "\xff\xff\xff\xff\xff\xff\xff\xfe" {
+		t.Fatalf("unexpected counter encoding; got %q", v)
+	}
+
+	// Overflow leaves the counter unchanged.
+	s.Set(k, []byte("\x7f\xff\xff\xff\xff\xff\xff\xff"))
+	if _, err := s.IncrBy(k, 1); !errors.Is(err, ErrCounterOverflow) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrCounterOverflow)
+	}
+	if _, err := s.DecrBy(k, math.MinInt64); !errors.Is(err, ErrCounterOverflow) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrCounterOverflow)
+	}
+	if n, err := s.DecrBy(k, math.MaxInt64); err != nil || n != 0 {
+		t.Fatalf("unexpected DecrBy result; got %d, %v; want %d, %v", n, err, 0, nil)
+	}
+	s.Set(k, []byte("\x80\x00\x00\x00\x00\x00\x00\x00"))
+	if _, err := s.DecrBy(k, 1); !errors.Is(err, ErrCounterOverflow) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrCounterOverflow)
+	}
+	if n, err := s.GetInt(k); err != nil || n != math.MinInt64 {
+		t.Fatalf("unexpected GetInt result; got %d, %v; want %d, %v", n, err, int64(math.MinInt64), nil)
+	}
+
+	// Subtracting math.MinInt64 fits int64 for negative counters.
+	s.Set(k, []byte("\xff\xff\xff\xff\xff\xff\xff\xff"))
+	if n, err := s.DecrBy(k, math.MinInt64); err != nil || n != math.MaxInt64 {
+		t.Fatalf("unexpected DecrBy result; got %d, %v; want %d, %v", n, err, int64(math.MaxInt64), nil)
+	}
+	if _, err := s.DecrBy(k, -1); !errors.Is(err, ErrCounterOverflow) {
+		t.Fatalf("unexpected error; got %v; want %v", err, ErrCounterOverflow)
+	}
+
+	// Invalid encodings are reported and left unchanged.
+	for _, v := range []string{"", "1", "123456789"} {
+		s.Set(k, []byte(v))
+		if _, err := s.IncrBy(k, 1); !errors.Is(err, ErrInvalidCounter) {
+			t.Fatalf("unexpected error for value %q; got %v; want %v", v, err, ErrInvalidCounter)
+		}
+		if _, err := s.GetInt(k); !errors.Is(err, ErrInvalidCounter) {
+			t.Fatalf("unexpected error for value %q; got %v; want %v", v, err, ErrInvalidCounter)
+		}
+		if got := s.Get(nil, k); string(got) != v {
+			t.Fatalf("invalid counter must be kept; got %q; want %q", got, v)
+		}
+	}
+	checkBuckets(t, s)
+}
+
+func TestStorageCounterConcurrent(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	const workers = 8
+	const incrs = 1000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < incrs; j++ {
+				k := []byte(fmt.Sprintf("counter %d", j%10))
+				var err error
+				if n%2 == 0 {
+					_, err = s.IncrBy(k, 3)
+				} else {
+					_, err = s.DecrBy(k, 1)
+				}
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		k := []byte(fmt.Sprintf("counter %d", i))
+		want := int64(workers / 2 * incrs / 10 * (3 - 1))
+		if n, err := s.GetInt(k); err != nil || n != want {
+			t.Fatalf("unexpected counter %q; got %d, %v; want %d", k, n, err, want)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package bytestorage
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// EvictionPolicy defines which entry is evicted from a full bucket.
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently used entry.
+	//
+	// Every Get and Has moves the entry to the head of the bucket list,
+	// which requires short exclusive lock even for reads.
+	EvictLRU EvictionPolicy = iota
+
+	// EvictClock approximates LRU with a reference bit per entry.
+	//
+	// Reads only set the bit, so they aren't serialized like with EvictLRU.
+	EvictClock
+
+	// EvictRandom evicts a random entry.
+	EvictRandom
+)
+
+// Limits limits the storage size.
+//
+// Limits are applied to every bucket separately, each bucket gets
+// 1/Options.BucketsCount share of the limit. So the storage may start evicting
+// entries before the limit is reached if keys are unevenly distributed.
+//
+// Every bucket keeps at least the last written entry, so the number
+// of buckets is reduced for small limits until every bucket gets
+// at least one entry and 64 bytes. The storage still exceeds MaxBytes
+// if entries are bigger than the bucket share of MaxBytes.
+type Limits struct {
+	// MaxBytes is the maximum size of all keys and values in bytes.
+	// Zero means no limit.
+	MaxBytes uint64
+
+	// MaxEntries is the maximum number of entries.
+	// Zero means no limit.
+	MaxEntries uint64
+
+	// Policy is the eviction policy used when the limit is exceeded.
+	Policy EvictionPolicy
+
+	// TinyLFU enables W-TinyLFU admission.
+	//
+	// New entries are placed into a small window LRU. When the window
+	// is full, its oldest entry is admitted to the main space only if it
+	// was accessed more often than the entry chosen by Policy for eviction.
+	// This protects frequently used entries from scans.
+	TinyLFU bool
+}
+
+// NewBounded returns new Storage, which evicts entries
+// when the given limits are exceeded.
+//
+// Use NewWithOptions for combining limits with other options.
+func NewBounded(l Limits) *Storage {
+	return NewWithOptions(Options{Limits: l})
+}
+
+// Minimum bucket share of Limits.MaxBytes.
+const minBucketBytes = 64
+
+// limitBuckets returns the number of buckets reduced from n until
+// every bucket share of l holds at least one entry.
+func limitBuckets(n uint64, l Limits) uint64 {
+	for n > 1 && (l.MaxEntries != 0 && l.MaxEntries < n || l.MaxBytes != 0 && l.MaxBytes < n*minBucketBytes) {
+		n >>= 1
+	}
+	return n
+}
+
+// limitShare returns the share of limit for the bucket i out of n.
+//
+// Shares are rounded down and the remainder is spread over the first
+// buckets, so the shares sum up to limit.
+func limitShare(limit, n, i uint64) uint64 {
+	share := limit / n
+	if i < limit%n {
+		share++
+	}
+	return share
+}
+
+// No entry marker for LRU list.
+const noIdx = ^uint64(0)
+
+// evictor holds the eviction state of a bucket.
+//
+// Fields are guarded by the bucket lock, except for the LRU list,
+// which is also modified by readers under mu.
+type evictor struct {
+	maxBytes   uint64
+	maxEntries uint64
+	policy     EvictionPolicy
+	tinyLFU    bool
+
+	// mu guards the lists and the sketch on the read path.
+	mu sync.Mutex
+
+	// LRU list of kv entries in the main space.
+	lru lruList
+
+	// Admission window and frequency sketch for W-TinyLFU.
+	window   lruList
+	windowed []bool
+	sketch   *sketch
+
+	// CLOCK reference bits of kv entries and the clock hand.
+	refs []uint32
+	hand uint64
+
+	evictions atomic.Uint64
+}
+
+type lruLink struct {
+	prev uint64
+	next uint64
+}
+
+// lruList is a list of kv entries from the most to the least recently used.
+type lruList struct {
+	links []lruLink
+	head  uint64
+	tail  uint64
+	len   uint64
+}
+
+func (l *lruList) init(n int) {
+	l.links = make([]lruLink, n)
+	l.head, l.tail = noIdx, noIdx
+	l.len = 0
+}
+
+func (l *lruList) push(idx uint64) {
+	p := &l.links[idx]
+	p.prev = noIdx
+	p.next = l.head
+	if l.head != noIdx {
+		l.links[l.head].prev = idx
+	} else {
+		l.tail = idx
+	}
+	l.head = idx
+	l.len++
+}
+
+func (l *lruList) unlink(idx uint64) {
+	p := l.links[idx]
+	if p.prev != noIdx {
+		l.links[p.prev].next = p.next
+	} else {
+		l.head = p.next
+	}
+	if p.next != noIdx {
+		l.links[p.next].prev = p.prev
+	} else {
+		l.tail = p.prev
+	}
+	l.len--
+}
+
+func (l *lruList) moveToFront(idx uint64) {
+	if l.head != idx {
+		l.unlink(idx)
+		l.push(idx)
+	}
+}
+
+// last returns the least recently used entry except for keep.
+func (l *lruList) last(keep uint64) uint64 {
+	idx := l.tail
+	if idx == keep && idx != noIdx {
+		idx = l.links[idx].prev
+	}
+	return idx
+}
+
+// limited returns true if the bucket has limits.
+func (ev *evictor) limited() bool {
+	return ev.maxBytes != 0 || ev.maxEntries != 0
+}
+
+// init allocates per-entry state for n entries.
+func (ev *evictor) init(n int) {
+	ev.hand = 0
+	if !ev.limited() {
+		return
+	}
+	switch ev.policy {
+	case EvictLRU:
+		ev.lru.init(n)
+	case EvictClock:
+		ev.refs = make([]uint32, n)
+	}
+	if ev.tinyLFU {
+		ev.window.init(n)
+		ev.windowed = make([]bool, n)
+		ev.sketch = newSketch(ev.sketchWidth())
+	}
+}
+
+// grow adds state for a new kv entry appended to the bucket.
+func (ev *evictor) grow() {
+	if ev.lru.links != nil {
+		ev.lru.links = append(ev.lru.links, lruLink{})
+	}
+	if ev.refs != nil {
+		ev.refs = append(ev.refs, 0)
+	}
+	if ev.windowed != nil {
+		ev.window.links = append(ev.window.links, lruLink{})
+		ev.windowed = append(ev.windowed, false)
+	}
+}
+
+// insert registers new entry kv[idx].
+//
+// Must be called under the bucket write lock.
+func (ev *evictor) insert(idx uint64) {
+	if ev.windowed != nil {
+		// New entries stay in the window until admitted.
+		ev.window.push(idx)
+		ev.windowed[idx] = true
+		return
+	}
+	ev.admit(idx)
+}
+
+// admit moves kv[idx] to the main space.
+func (ev *evictor) admit(idx uint64) {
+	if ev.lru.links != nil {
+		ev.lru.push(idx)
+	}
+	if ev.refs != nil {
+		ev.refs[idx] = 1
+	}
+}
+
+// touch marks kv[idx] as recently used.
+//
+// May be called under the bucket read lock.
+func (ev *evictor) touch(idx uint64) {
+	if ev.windowed != nil && ev.windowed[idx] {
+		ev.mu.Lock()
+		ev.window.moveToFront(idx)
+		ev.mu.Unlock()
+		return
+	}
+	if ev.lru.links != nil {
+		ev.mu.Lock()
+		ev.lru.moveToFront(idx)
+		ev.mu.Unlock()
+	}
+	if ev.refs != nil && atomic.LoadUint32(&ev.refs[idx]) == 0 {
+		atomic.StoreUint32(&ev.refs[idx], 1)
+	}
+}
+
+// delete forgets removed entry kv[idx].
+//
+// Must be called under the bucket write lock.
+func (ev *evictor) delete(idx uint64) {
+	if ev.windowed != nil && ev.windowed[idx] {
+		ev.window.unlink(idx)
+		ev.windowed[idx] = false
+		return
+	}
+	if ev.lru.links != nil {
+		ev.lru.unlink(idx)
+	}
+	if ev.refs != nil {
+		ev.refs[idx] = 0
+	}
+}
+
+// overflow returns true if the bucket exceeds its limits.
+//
+// Must be called under the bucket lock.
+func (b *bucket) overflow() bool {
+	return b.ev.maxBytes != 0 && b.size.Load() > b.ev.maxBytes ||
+		b.ev.maxEntries != 0 && b.entries > b.ev.maxEntries
+}
+
+// evict removes entries until the bucket fits its limits.
+// kv[keep] is never evicted, so an entry bigger than the bucket
+// share of MaxBytes stays in the bucket alone.
+//
+// Must be called under the bucket write lock.
+func (b *bucket) evict(keep uint64) {
+	if b.ev.windowed != nil {
+		b.evictTinyLFU(keep)
+		return
+	}
+	for b.overflow() {
+		idx, ok := b.victim(keep)
+		if !ok {
+			return
+		}
+		b.evictEntry(idx)
+	}
+}
+
+// victim returns an entry of the main space to evict according
+// to the bucket policy.
+func (b *bucket) victim(keep uint64) (uint64, bool) {
+	if b.entries < 2 {
+		return 0, false
+	}
+	switch b.ev.policy {
+	case EvictLRU:
+		idx := b.ev.lru.last(keep)
+		return idx, idx != noIdx
+	case EvictClock:
+		// Every live entry gets its bit cleared during the first pass,
+		// so the victim is always found during the second pass.
+		for i := uint64(0); i < 2*b.offset; i++ {
+			if b.ev.hand >= b.offset {
+				b.ev.hand = 0
+			}
+			idx := b.ev.hand
+			b.ev.hand++
+			if !b.candidate(idx, keep) {
+				continue
+			}
+			if b.ev.refs[idx] != 0 {
+				b.ev.refs[idx] = 0
+				continue
+			}
+			return idx, true
+		}
+		return 0, false
+	default:
+		// Start from a random position and pick the first live entry.
+		start := uint64(rand.Int63n(int64(b.offset)))
+		for i := uint64(0); i < b.offset; i++ {
+			idx := (start + i) % b.offset
+			if b.candidate(idx, keep) {
+				return idx, true
+			}
+		}
+		return 0, false
+	}
+}
+
+// candidate returns true if kv[idx] may be evicted from the main space.
+func (b *bucket) candidate(idx, keep uint64) bool {
+	if idx == keep || b.ev.windowed != nil && b.ev.windowed[idx] {
+		return false
+	}
+	return b.live(idx)
+}
+
+// live returns true if kv[idx] holds an entry.
+//
+// Must be called under the bucket lock.
+func (b *bucket) live(idx uint64) bool {
+	h := b.slots[idx].h
+	if i, found := b.m[h]; found {
+		return i == idx
+	}
+	for _, i := range b.col[h] {
+		if i == idx {
+			return true
+		}
+	}
+	return false
+}
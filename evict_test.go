@@ -0,0 +1,325 @@
+package bytestorage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var evictionPolicies = []EvictionPolicy{EvictLRU, EvictClock, EvictRandom}
+
+func TestBoundedMaxEntries(t *testing.T) {
+	for _, policy := range evictionPolicies {
+		t.Run(fmt.Sprintf("policy_%d", policy), func(t *testing.T) {
+			const maxEntries = 10 * bucketsCount
+			s := NewBounded(Limits{MaxEntries: maxEntries, Policy: policy})
+			defer s.Reset()
+
+			const itemsCount = 100000
+			for i := 0; i < itemsCount; i++ {
+				k := []byte(fmt.Sprintf("key %d", i))
+				s.Set(k, k)
+				if !s.Has(k) {
+					t.Fatalf("just set key %q is missing", k)
+				}
+			}
+			checkBuckets(t, s)
+			var stats Stats
+			s.UpdateStats(&stats)
+			n := s.EntriesCount()
+			if n > maxEntries {
+				t.Fatalf("too many entries; got %d; want at most %d", n, maxEntries)
+			}
+			if stats.Evictions != itemsCount-n {
+				t.Fatalf("unexpected evictions; got %d; want %d", stats.Evictions, itemsCount-n)
+			}
+		})
+	}
+}
+
+func TestBoundedMaxBytes(t *testing.T) {
+	for _, policy := range evictionPolicies {
+		t.Run(fmt.Sprintf("policy_%d", policy), func(t *testing.T) {
+			const maxBytes = 1 << 20
+			s := NewBounded(Limits{MaxBytes: maxBytes, Policy: policy})
+			defer s.Reset()
+
+			v := make([]byte, 100)
+			for i := 0; i < 100000; i++ {
+				s.Set([]byte(fmt.Sprintf("key %d", i)), v)
+			}
+			// Replacing with bigger values must evict too.
+			for i := 0; i < 100000; i += 7 {
+				s.Set([]byte(fmt.Sprintf("key %d", i)), make([]byte, 1000))
+			}
+			checkBuckets(t, s)
+			if size := s.Size(); size > maxBytes {
+				t.Fatalf("storage exceeds the limit; got %d bytes; want at most %d", size, maxBytes)
+			}
+
+			// Entry bigger than the bucket share is kept alone.
+			k := []byte("big")
+			big := make([]byte, 2*maxBytes/bucketsCount)
+			s.Set(k, big)
+			if v := s.Get(nil, k); len(v) != len(big) {
+				t.Fatalf("unexpected value length; got %d; want %d", len(v), len(big))
+			}
+			if n := s.buckets[s.hasher.Hash(k)&s.mask].getEntriesCount(); n != 1 {
+				t.Fatalf("unexpected entries count in bucket; got %d; want %d", n, 1)
+			}
+		})
+	}
+}
+
+func TestBoundedSmallLimits(t *testing.T) {
+	for _, l := range []Limits{{MaxEntries: 100}, {MaxEntries: 1}, {MaxEntries: 1000}, {MaxBytes: 1000}, {MaxBytes: 100000}} {
+		t.Run(fmt.Sprintf("%+v", l), func(t *testing.T) {
+			s := NewBounded(l)
+			defer s.Reset()
+
+			for i := 0; i < 10000; i++ {
+				k := []byte(fmt.Sprintf("key %d", i))
+				s.Set(k, k)
+			}
+			checkBuckets(t, s)
+			if n := s.EntriesCount(); l.MaxEntries != 0 && n > l.MaxEntries {
+				t.Fatalf("too many entries; got %d; want at most %d", n, l.MaxEntries)
+			}
+			if size := s.Size(); l.MaxBytes != 0 && size > l.MaxBytes {
+				t.Fatalf("storage exceeds the limit; got %d bytes; want at most %d", size, l.MaxBytes)
+			}
+			// Shares of buckets sum up to the limit.
+			var maxEntries, maxBytes uint64
+			for i := range s.buckets {
+				maxEntries += s.buckets[i].ev.maxEntries
+				maxBytes += s.buckets[i].ev.maxBytes
+			}
+			if maxEntries != l.MaxEntries || maxBytes != l.MaxBytes {
+				t.Fatalf("unexpected sum of bucket limits; got %d entries, %d bytes; want %d, %d", maxEntries, maxBytes, l.MaxEntries, l.MaxBytes)
+			}
+		})
+	}
+}
+
+func TestBoundedLRU(t *testing.T) {
+	s := NewBounded(Limits{MaxEntries: 3 * bucketsCount, Policy: EvictLRU})
+	defer s.Reset()
+
+	b := &s.buckets[0]
+	keys := keysForBucket(s, 0, 5)
+	for _, k := range keys[:3] {
+		s.Set(k, k)
+	}
+	// Make the oldest entry the most recently used.
+	if !s.Has(keys[0]) {
+		t.Fatalf("missing key %q", keys[0])
+	}
+	s.Set(keys[3], keys[3])
+	if s.Has(keys[1]) {
+		t.Fatalf("least recently used key %q must be evicted", keys[1])
+	}
+	s.Get(nil, keys[2])
+	s.Set(keys[4], keys[4])
+	if s.Has(keys[0]) {
+		t.Fatalf("least recently used key %q must be evicted", keys[0])
+	}
+	for _, k := range keys[2:] {
+		if v := s.Get(nil, k); string(v) != string(k) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, k)
+		}
+	}
+	if b.ev.evictions.Load() != 2 {
+		t.Fatalf("unexpected evictions; got %d; want %d", b.ev.evictions.Load(), 2)
+	}
+}
+
+func TestBoundedWAL(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	w, err := OpenWAL(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	opts := Options{BucketsCount: 1, Limits: Limits{MaxEntries: 2, Policy: EvictLRU}}
+	s := NewWithOptions(opts)
+	s.AttachWAL(w)
+	s.Set([]byte("a"), []byte("a"))
+	s.Set([]byte("b"), []byte("b"))
+	// Reads change the eviction order, but they aren't logged.
+	s.Get(nil, []byte("a"))
+	s.Set([]byte("c"), []byte("c"))
+	s.AttachWAL(nil)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	w, err = OpenWAL(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	defer w.Close()
+	opts.Hasher = s.hasher
+	for _, s1 := range []*Storage{NewWithOptions(opts), NewWithOptions(Options{Hasher: s.hasher})} {
+		if err := w.Replay(s1); err != nil {
+			t.Fatalf("Replay error: %s", err)
+		}
+		for _, k := range []string{"a", "b", "c"} {
+			if s1.Has([]byte(k)) != s.Has([]byte(k)) {
+				t.Fatalf("unexpected existence of key %q after replay; got %v; want %v", k, s1.Has([]byte(k)), s.Has([]byte(k)))
+			}
+		}
+	}
+}
+
+func TestBoundedClock(t *testing.T) {
+	s := NewBounded(Limits{MaxEntries: 3 * bucketsCount, Policy: EvictClock})
+	defer s.Reset()
+
+	keys := keysForBucket(s, 0, 5)
+	for _, k := range keys[:3] {
+		s.Set(k, k)
+	}
+	// All the reference bits are set, so the hand clears them
+	// and evicts the first entry.
+	s.Set(keys[3], keys[3])
+	if s.Has(keys[0]) {
+		t.Fatalf("key %q must be evicted", keys[0])
+	}
+	// Referenced entry gets the second chance.
+	s.Get(nil, keys[1])
+	s.Set(keys[4], keys[4])
+	if !s.Has(keys[1]) {
+		t.Fatalf("referenced key %q must be kept", keys[1])
+	}
+	if s.Has(keys[2]) {
+		t.Fatalf("key %q must be evicted", keys[2])
+	}
+}
+
+func TestBoundedCollision(t *testing.T) {
+	for _, policy := range evictionPolicies {
+		t.Run(fmt.Sprintf("policy_%d", policy), func(t *testing.T) {
+			s := NewBounded(Limits{MaxEntries: 2 * bucketsCount, Policy: policy})
+			defer s.Reset()
+
+			b := &s.buckets[brokenHash%bucketsCount]
+			s.colSet([]byte("aaa"), []byte("bbb"), brokenHash)
+			s.colSet([]byte("bbb"), []byte("ccc"), brokenHash)
+			s.colSet([]byte("ccc"), []byte("ddd"), brokenHash)
+			if n := b.getEntriesCount(); n != 2 {
+				t.Fatalf("unexpected entries count; got %d; want %d", n, 2)
+			}
+			if v := s.colGet(nil, []byte("ccc"), brokenHash); string(v) != "ddd" {
+				t.Fatalf("unexpected value obtained; got %q; want %q", v, "ddd")
+			}
+			checkBuckets(t, s)
+
+			// Evicting from the chain collapses it into m.
+			k := keysForBucket(s, brokenHash&s.mask, 1)[0]
+			s.Set(k, k)
+			if len(b.col) != 0 || len(b.m) != 2 {
+				t.Fatalf("collision chain must be collapsed into m; col=%v, m=%v", b.col, b.m)
+			}
+			checkBuckets(t, s)
+		})
+	}
+}
+
+func TestBoundedConcurrent(t *testing.T) {
+	for _, policy := range evictionPolicies {
+		for _, tinyLFU := range []bool{false, true} {
+			t.Run(fmt.Sprintf("policy_%d_tinylfu_%v", policy, tinyLFU), func(t *testing.T) {
+				testBoundedConcurrent(t, Limits{MaxEntries: 4 * bucketsCount, Policy: policy, TinyLFU: tinyLFU})
+			})
+		}
+	}
+}
+
+func testBoundedConcurrent(t *testing.T, l Limits) {
+	s := NewBounded(l)
+	defer s.Reset()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				k := []byte(fmt.Sprintf("key %d", (j*7+n)%5000))
+				if j%3 == 0 {
+					s.Set(k, k)
+				} else if v, ok := s.HasGet(nil, k); ok && string(v) != string(k) {
+					t.Errorf("unexpected value for key %q; got %q", k, v)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	checkBuckets(t, s)
+}
+
+// keysForBucket returns n keys stored in the bucket with the given index.
+func keysForBucket(s *Storage, idx uint64, n int) [][]byte {
+	var keys [][]byte
+	for i := 0; len(keys) < n; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if s.hasher.Hash(k)&s.mask == idx {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// checkBuckets verifies that m, col, free and size of every bucket agree with kv.
+func checkBuckets(t *testing.T, s *Storage) {
+	t.Helper()
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		b.mu.RLock()
+		seen := make(map[uint64]bool)
+		var size uint64
+		for h, idx := range b.m {
+			if b.slots[idx].h != h {
+				t.Fatalf("bucket %d: unexpected hash of entry %d; got %d; want %d", i, idx, b.slots[idx].h, h)
+			}
+			seen[idx] = true
+			size += uint64(len(b.kv[idx][0]) + len(b.kv[idx][1]))
+		}
+		for h, idxs := range b.col {
+			if len(idxs) < 2 {
+				t.Fatalf("bucket %d: collision chain of %d entries", i, len(idxs))
+			}
+			for _, idx := range idxs {
+				if b.slots[idx].h != h {
+					t.Fatalf("bucket %d: unexpected hash of entry %d; got %d; want %d", i, idx, b.slots[idx].h, h)
+				}
+				seen[idx] = true
+				size += uint64(len(b.kv[idx][0]) + len(b.kv[idx][1]))
+			}
+		}
+		for _, idx := range b.free {
+			if seen[idx] {
+				t.Fatalf("bucket %d: entry %d is both live and free", i, idx)
+			}
+			seen[idx] = true
+		}
+		if uint64(len(seen)) != b.offset {
+			t.Fatalf("bucket %d: unexpected number of used entries; got %d; want %d", i, len(seen), b.offset)
+		}
+		if size != b.size.Load() {
+			t.Fatalf("bucket %d: unexpected size; got %d; want %d", i, b.size.Load(), size)
+		}
+		var allocated uint64
+		for _, kv := range b.kv {
+			allocated += uint64(cap(kv[0]) + cap(kv[1]))
+		}
+		if allocated != b.allocated.Load() {
+			t.Fatalf("bucket %d: unexpected allocated bytes; got %d; want %d", i, b.allocated.Load(), allocated)
+		}
+		if n := uint64(len(seen) - len(b.free)); n != b.entries {
+			t.Fatalf("bucket %d: unexpected entries; got %d; want %d", i, b.entries, n)
+		}
+		b.mu.RUnlock()
+	}
+}
@@ -0,0 +1,100 @@
+// Package fastcachecompat connects bytestorage with fastcache.
+//
+// It is kept apart from bytestorage, so only its users link fastcache.
+package fastcachecompat
+
+import (
+	"github.com/VictoriaMetrics/fastcache"
+
+	"github.com/kiriklo/bytestorage"
+)
+
+// FromFastcache returns bytestorage.Cache backed by c.
+func FromFastcache(c *fastcache.Cache) bytestorage.Cache {
+	return &fastcacheAdapter{c: c}
+}
+
+type fastcacheAdapter struct {
+	c *fastcache.Cache
+}
+
+func (a *fastcacheAdapter) Set(k, v []byte) {
+	a.c.Set(k, v)
+}
+
+func (a *fastcacheAdapter) Get(dst, k []byte) []byte {
+	return a.c.Get(dst, k)
+}
+
+func (a *fastcacheAdapter) HasGet(dst, k []byte) ([]byte, bool) {
+	return a.c.HasGet(dst, k)
+}
+
+func (a *fastcacheAdapter) Has(k []byte) bool {
+	return a.c.Has(k)
+}
+
+func (a *fastcacheAdapter) Del(k []byte) {
+	a.c.Del(k)
+}
+
+func (a *fastcacheAdapter) Reset() {
+	a.c.Reset()
+}
+
+func (a *fastcacheAdapter) UpdateStats(s *bytestorage.Stats) {
+	var fs fastcache.Stats
+	a.c.UpdateStats(&fs)
+	AddFastcacheStats(s, &fs)
+}
+
+func (a *fastcacheAdapter) SaveToFile(filePath string) error {
+	return a.c.SaveToFile(filePath)
+}
+
+// FastcacheCompat wraps bytestorage.Storage, so it has the same methods
+// as fastcache.Cache, including UpdateStats with fastcache.Stats.
+//
+// Other Storage methods are available via the embedded Storage.
+type FastcacheCompat struct {
+	*bytestorage.Storage
+}
+
+// UpdateStats adds storage stats to fs using fastcache.Stats field names.
+//
+// Call fs.Reset before calling UpdateStats if fs is re-used.
+func (fc FastcacheCompat) UpdateStats(fs *fastcache.Stats) {
+	var s bytestorage.Stats
+	fc.Storage.UpdateStats(&s)
+	AddToFastcacheStats(fs, &s)
+}
+
+// AddFastcacheStats adds fastcache stats fs to s.
+//
+// Hits are computed from GetCalls and Misses.
+// Fields without counterpart in bytestorage.Stats are ignored.
+func AddFastcacheStats(s *bytestorage.Stats, fs *fastcache.Stats) {
+	s.GetCalls += fs.GetCalls
+	s.SetCalls += fs.SetCalls
+	if fs.GetCalls > fs.Misses {
+		// Counters of fastcache are loaded one by one,
+		// so Misses may include calls missing in GetCalls.
+		s.Hits += fs.GetCalls - fs.Misses
+	}
+	s.Misses += fs.Misses
+	s.Collisions += fs.Collisions
+	s.EntriesCount += fs.EntriesCount
+	s.BytesSize += fs.BytesSize
+}
+
+// AddToFastcacheStats adds s to fastcache stats fs.
+//
+// Fields without counterpart in fastcache.Stats are ignored.
+func AddToFastcacheStats(fs *fastcache.Stats, s *bytestorage.Stats) {
+	fs.GetCalls += s.GetCalls
+	fs.SetCalls += s.SetCalls
+	fs.Misses += s.Misses
+	fs.Collisions += s.Collisions
+	fs.EntriesCount += s.EntriesCount
+	fs.BytesSize += s.BytesSize
+}
@@ -0,0 +1,177 @@
+package fastcachecompat
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/VictoriaMetrics/fastcache"
+
+	"github.com/kiriklo/bytestorage"
+)
+
+// fastcacheMethods is the method set of fastcache.Cache.
+type fastcacheMethods interface {
+	Set(k, v []byte)
+	Get(dst, k []byte) []byte
+	HasGet(dst, k []byte) ([]byte, bool)
+	Has(k []byte) bool
+	Del(k []byte)
+	Reset()
+	UpdateStats(s *fastcache.Stats)
+	SaveToFile(filePath string) error
+	SaveToFileConcurrent(filePath string, concurrency int) error
+	SetBig(k, v []byte)
+	GetBig(dst, k []byte) []byte
+}
+
+var (
+	_ fastcacheMethods = (*fastcache.Cache)(nil)
+	_ fastcacheMethods = FastcacheCompat{}
+)
+
+// cacheImpl creates and loads Cache implementation under test.
+type cacheImpl struct {
+	name string
+	new  func() bytestorage.Cache
+	load func(filePath string) (bytestorage.Cache, error)
+}
+
+var cacheImpls = []cacheImpl{
+	{
+		name: "bytestorage",
+		new:  func() bytestorage.Cache { return bytestorage.New() },
+		load: func(filePath string) (bytestorage.Cache, error) { return bytestorage.LoadFromFile(filePath) },
+	},
+	{
+		name: "fastcache",
+		new:  func() bytestorage.Cache { return FromFastcache(fastcache.New(32 << 20)) },
+		load: func(filePath string) (bytestorage.Cache, error) {
+			c, err := fastcache.LoadFromFile(filePath)
+			if err != nil {
+				return nil, err
+			}
+			return FromFastcache(c), nil
+		},
+	},
+}
+
+func TestCacheConformance(t *testing.T) {
+	for _, impl := range cacheImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			testCacheConformance(t, impl)
+		})
+	}
+}
+
+func testCacheConformance(t *testing.T, impl cacheImpl) {
+	c := impl.new()
+	defer c.Reset()
+
+	// Missing key.
+	if v := c.Get([]byte("dst"), []byte("missing")); string(v) != "dst" {
+		t.Fatalf("unexpected value for missing key; got %q; want %q", v, "dst")
+	}
+	if v, ok := c.HasGet(nil, []byte("missing")); ok || len(v) != 0 {
+		t.Fatalf("unexpected value for missing key; got %q, %v", v, ok)
+	}
+	if c.Has([]byte("missing")) {
+		t.Fatalf("unexpected missing key")
+	}
+
+	// Set, overwrite and empty values.
+	c.Set([]byte("key"), []byte("value"))
+	c.Set([]byte("key"), []byte("new value"))
+	c.Set([]byte("empty"), nil)
+	c.Set(nil, []byte("nil key"))
+	if v := c.Get([]byte("dst "), []byte("key")); string(v) != "dst new value" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "dst new value")
+	}
+	if v, ok := c.HasGet(nil, []byte("empty")); !ok || len(v) != 0 {
+		t.Fatalf("unexpected empty value; got %q, %v; want %q, %v", v, ok, "", true)
+	}
+	if v := c.Get(nil, nil); string(v) != "nil key" {
+		t.Fatalf("unexpected value for nil key; got %q; want %q", v, "nil key")
+	}
+
+	// Del.
+	c.Del([]byte("key"))
+	c.Del([]byte("missing"))
+	if c.Has([]byte("key")) {
+		t.Fatalf("unexpected deleted key %q", "key")
+	}
+	if !c.Has([]byte("empty")) {
+		t.Fatalf("missing key %q", "empty")
+	}
+
+	// Stats.
+	c.Reset()
+	const itemsCount = 1000
+	for i := 0; i < itemsCount; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		c.Set(k, k)
+	}
+	for i := 0; i < 2*itemsCount; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if v := c.Get(nil, k); i < itemsCount && string(v) != string(k) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, k)
+		}
+	}
+	var s bytestorage.Stats
+	c.UpdateStats(&s)
+	if s.SetCalls != itemsCount {
+		t.Fatalf("unexpected SetCalls; got %d; want %d", s.SetCalls, itemsCount)
+	}
+	if s.GetCalls != 2*itemsCount {
+		t.Fatalf("unexpected GetCalls; got %d; want %d", s.GetCalls, 2*itemsCount)
+	}
+	if s.Misses != itemsCount {
+		t.Fatalf("unexpected Misses; got %d; want %d", s.Misses, itemsCount)
+	}
+	if s.Hits != itemsCount {
+		t.Fatalf("unexpected Hits; got %d; want %d", s.Hits, itemsCount)
+	}
+	if s.EntriesCount != itemsCount {
+		t.Fatalf("unexpected EntriesCount; got %d; want %d", s.EntriesCount, itemsCount)
+	}
+	if s.BytesSize == 0 {
+		t.Fatalf("BytesSize must be positive")
+	}
+
+	// SaveToFile.
+	filePath := filepath.Join(t.TempDir(), "TestCacheConformance")
+	if err := c.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	c1, err := impl.load(filePath)
+	if err != nil {
+		t.Fatalf("cannot load saved cache: %s", err)
+	}
+	defer c1.Reset()
+	for i := 0; i < itemsCount; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if v := c1.Get(nil, k); string(v) != string(k) {
+			t.Fatalf("unexpected value for key %q after load; got %q; want %q", k, v, k)
+		}
+	}
+}
+
+func TestFastcacheCompat(t *testing.T) {
+	fc := FastcacheCompat{bytestorage.New()}
+	defer fc.Reset()
+
+	fc.Set([]byte("key"), []byte("value"))
+	fc.Get(nil, []byte("key"))
+	fc.Get(nil, []byte("missing"))
+	var fs fastcache.Stats
+	fc.UpdateStats(&fs)
+	if fs.SetCalls != 1 || fs.GetCalls != 2 || fs.Misses != 1 || fs.BytesSize != 8 {
+		t.Fatalf("unexpected stats; got %+v", fs)
+	}
+
+	var s bytestorage.Stats
+	AddFastcacheStats(&s, &fs)
+	if s.SetCalls != 1 || s.GetCalls != 2 || s.Misses != 1 || s.BytesSize != 8 {
+		t.Fatalf("unexpected stats; got %+v", s)
+	}
+}
@@ -0,0 +1,519 @@
+package bytestorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"time"
+
+	"github.com/zeebo/xxh3"
+)
+
+const (
+	// Magic number at the beginning of metadata.bin ("bytestor").
+	fileMagic uint64 = 0x726f747365747962
+
+	// Version of the on-disk format. Must be increased on every
+	// incompatible change of the file layout.
+	fileVersion uint64 = 1
+
+	// Size of the format header.
+	headerSize = 6 * 8
+)
+
+// SaveToFile atomically saves storage data to the given filePath using a single
+// CPU core.
+//
+// SaveToFile may be called concurrently with other operations on the storage.
+//
+// The saved data may be loaded with LoadFromFile*.
+//
+// See also SaveToFileConcurrent for faster saving to file.
+func (s *Storage) SaveToFile(filePath string) error {
+	return s.SaveToFileConcurrent(filePath, 1)
+}
+
+// SaveToFileConcurrent saves storage data to the given filePath using concurrency
+// CPU cores.
+//
+// SaveToFileConcurrent may be called concurrently with other operations
+// on the storage.
+//
+// The saved data may be loaded with LoadFromFile*.
+//
+// See also SaveToFile.
+func (s *Storage) SaveToFileConcurrent(filePath string, concurrency int) error {
+	// Create dir if it doesn't exist.
+	dir := filepath.Dir(filePath)
+	if _, err := os.Stat(dir); err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("cannot stat %q: %w", dir, err)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("cannot create dir %q: %w", dir, err)
+		}
+	}
+
+	// Save storage data into a temporary directory.
+	tmpDir, err := os.MkdirTemp(dir, "bytestorage.tmp.")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary dir inside %q: %w", dir, err)
+	}
+	defer func() {
+		if tmpDir != "" {
+			_ = os.RemoveAll(tmpDir)
+		}
+	}()
+	gomaxprocs := runtime.GOMAXPROCS(-1)
+	if concurrency <= 0 || concurrency > gomaxprocs {
+		concurrency = gomaxprocs
+	}
+	if err := s.save(tmpDir, concurrency); err != nil {
+		return fmt.Errorf("cannot save storage data to temporary dir %q: %w", tmpDir, err)
+	}
+
+	// Remove old filePath contents, since os.Rename may return
+	// error if filePath dir exists.
+	if err := os.RemoveAll(filePath); err != nil {
+		return fmt.Errorf("cannot remove old contents at %q: %w", filePath, err)
+	}
+	if err := os.Rename(tmpDir, filePath); err != nil {
+		return fmt.Errorf("cannot move temporary dir %q to %q: %w", tmpDir, filePath, err)
+	}
+	tmpDir = ""
+	return nil
+}
+
+// LoadFromFile loads storage data from the given filePath.
+//
+// See SaveToFile* for saving storage data to file.
+func LoadFromFile(filePath string) (*Storage, error) {
+	return load(filePath, Options{})
+}
+
+// LoadFromFileWithOptions loads storage data from the given filePath
+// into storage created with NewWithOptions(opts).
+//
+// Keys are hashed again if opts.Hasher differs from the built-in hasher
+// of the saved storage. Data saved with a custom hasher must be loaded
+// with the same opts.Hasher.
+//
+// The number of buckets of the saved storage is used
+// if opts.BucketsCount isn't set.
+func LoadFromFileWithOptions(filePath string, opts Options) (*Storage, error) {
+	return load(filePath, opts)
+}
+
+// LoadFromFileOrNew tries loading storage data from the given filePath.
+//
+// The function falls back to creating new storage if error occurs
+// during loading the storage from file.
+func LoadFromFileOrNew(filePath string) *Storage {
+	s, err := load(filePath, Options{})
+	if err == nil {
+		return s
+	}
+	return New()
+}
+
+func (s *Storage) save(dir string, workersCount int) error {
+	if err := saveMetadata(dir, s.header()); err != nil {
+		return err
+	}
+
+	// Save buckets by workersCount concurrent workers.
+	workCh := make(chan int, workersCount)
+	results := make(chan error)
+	for i := 0; i < workersCount; i++ {
+		go func(workerNum int) {
+			results <- saveBuckets(s.buckets, workCh, dir, workerNum)
+		}(i)
+	}
+	// Feed workers with work
+	for i := range s.buckets {
+		workCh <- i
+	}
+	close(workCh)
+
+	// Read results.
+	var err error
+	for i := 0; i < workersCount; i++ {
+		result := <-results
+		if result != nil && err == nil {
+			err = result
+		}
+	}
+	return err
+}
+
+func load(filePath string, opts Options) (*Storage, error) {
+	hdr, err := loadMetadata(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read bucket files from filePath dir.
+	d, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %q: %w", filePath, err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	fis, err := d.Readdir(-1)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read files from %q: %w", filePath, err)
+	}
+	opts, err = hdr.options(opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load %q: %w", filePath, err)
+	}
+	s := NewWithOptions(opts)
+	results := make(chan error)
+	workersCount := 0
+	for _, fi := range fis {
+		fn := fi.Name()
+		if fi.IsDir() || !dataFileRegexp.MatchString(fn) {
+			continue
+		}
+		workersCount++
+		go func(dataPath string) {
+			results <- loadBuckets(s, dataPath, hdr)
+		}(filePath + "/" + fn)
+	}
+	err = nil
+	for i := 0; i < workersCount; i++ {
+		result := <-results
+		if result != nil && err == nil {
+			err = result
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Loading goes through bucket.set, so drop the calls it made.
+	for i := range s.buckets {
+		s.buckets[i].setCalls.Store(0)
+	}
+	return s, nil
+}
+
+func saveMetadata(dir string, hdr header) error {
+	metadataPath := dir + "/metadata.bin"
+	metadataFile, err := os.Create(metadataPath)
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %w", metadataPath, err)
+	}
+	defer func() {
+		_ = metadataFile.Close()
+	}()
+	if _, err := metadataFile.Write(appendHeader(nil, hdr)); err != nil {
+		return fmt.Errorf("cannot write metadata to %q: %w", metadataPath, err)
+	}
+	return metadataFile.Close()
+}
+
+func loadMetadata(dir string) (header, error) {
+	metadataPath := dir + "/metadata.bin"
+	buf, err := os.ReadFile(metadataPath)
+	if err != nil {
+		return header{}, fmt.Errorf("cannot read %q: %w", metadataPath, err)
+	}
+	r := bytes.NewReader(buf)
+	hdr, err := readHeader(r)
+	if err != nil {
+		return header{}, fmt.Errorf("invalid metadata in %q: %w", metadataPath, err)
+	}
+	if r.Len() != 0 {
+		return header{}, fmt.Errorf("unexpected size of %q; got %d bytes; want %d bytes", metadataPath, len(buf), len(buf)-r.Len())
+	}
+	return hdr, nil
+}
+
+// header contains fields of the format header.
+type header struct {
+	version      uint64
+	bucketsCount uint64
+	hasher       hasherID
+}
+
+// header returns the format header for s.
+func (s *Storage) header() header {
+	return header{
+		version:      fileVersion,
+		bucketsCount: uint64(len(s.buckets)),
+		hasher:       idOf(s.hasher),
+	}
+}
+
+// options returns opts for loading data with hdr.
+//
+// Missing opts are taken from hdr.
+func (hdr *header) options(opts Options) (Options, error) {
+	if opts.BucketsCount == 0 {
+		opts.BucketsCount = int(hdr.bucketsCount)
+	}
+	if opts.Hasher == nil {
+		opts.Hasher = hdr.hasher.hasher()
+		if opts.Hasher == nil {
+			return opts, fmt.Errorf("data was saved with custom Hasher; pass it via Options.Hasher")
+		}
+	}
+	return opts, nil
+}
+
+// appendHeader appends the format header to dst and returns the result.
+//
+// Header layout (all integers are little-endian uint64):
+//
+//	magic, version, bucketsCount, hasher kind, hasher seed,
+//	xxh3 checksum of everything above
+func appendHeader(dst []byte, hdr header) []byte {
+	start := len(dst)
+	dst = appendUint64(dst, fileMagic)
+	dst = appendUint64(dst, hdr.version)
+	dst = appendUint64(dst, hdr.bucketsCount)
+	dst = appendUint64(dst, hdr.hasher.kind)
+	dst = appendUint64(dst, hdr.hasher.seed)
+	return appendUint64(dst, xxh3.Hash(dst[start:]))
+}
+
+// readHeader reads and validates the header written by appendHeader.
+func readHeader(r io.Reader) (header, error) {
+	var hdr header
+	var buf [headerSize]byte
+	if _, err := io.ReadFull(r, buf[:16]); err != nil {
+		return hdr, err
+	}
+	if magic := binary.LittleEndian.Uint64(buf[:]); magic != fileMagic {
+		return hdr, fmt.Errorf("not a bytestorage data")
+	}
+	hdr.version = binary.LittleEndian.Uint64(buf[8:])
+	if hdr.version != fileVersion {
+		return hdr, fmt.Errorf("unsupported format version; got %d; want %d", hdr.version, fileVersion)
+	}
+	if _, err := io.ReadFull(r, buf[16:]); err != nil {
+		return hdr, unexpectedEOF(err)
+	}
+	if sum := binary.LittleEndian.Uint64(buf[headerSize-8:]); sum != xxh3.Hash(buf[:headerSize-8]) {
+		return hdr, fmt.Errorf("checksum mismatch")
+	}
+	hdr.bucketsCount = binary.LittleEndian.Uint64(buf[16:])
+	if hdr.bucketsCount == 0 || hdr.bucketsCount > maxBucketsCount {
+		return hdr, fmt.Errorf("invalid bucketsCount=%d", hdr.bucketsCount)
+	}
+	hdr.hasher.kind = binary.LittleEndian.Uint64(buf[24:])
+	hdr.hasher.seed = binary.LittleEndian.Uint64(buf[32:])
+	return hdr, nil
+}
+
+var dataFileRegexp = regexp.MustCompile(`^data\.\d+\.bin$`)
+
+func saveBuckets(buckets []bucket, workCh <-chan int, dir string, workerNum int) error {
+	dataPath := fmt.Sprintf("%s/data.%d.bin", dir, workerNum)
+	dataFile, err := os.Create(dataPath)
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %w", dataPath, err)
+	}
+	defer func() {
+		_ = dataFile.Close()
+	}()
+	bw := bufio.NewWriter(dataFile)
+	var buf []byte
+	var entries []entry
+	for bucketNum := range workCh {
+		buf, entries = buckets[bucketNum].marshal(buf[:0], entries)
+		if _, err := bw.Write(buf); err != nil {
+			return fmt.Errorf("cannot save bucket[%d] to %q: %w", bucketNum, dataPath, err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("cannot flush %q: %w", dataPath, err)
+	}
+	return dataFile.Close()
+}
+
+func loadBuckets(s *Storage, dataPath string, hdr header) error {
+	dataFile, err := os.Open(dataPath)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", dataPath, err)
+	}
+	defer func() {
+		_ = dataFile.Close()
+	}()
+	fi, err := dataFile.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat %q: %w", dataPath, err)
+	}
+	br := bufio.NewReader(dataFile)
+	rehash := mustRehash(hdr.hasher, idOf(s.hasher))
+	for {
+		entries, err := readBucket(br, uint64(fi.Size()))
+		if err == io.EOF {
+			// Reached the end of file.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot load bucket from %q: %w", dataPath, err)
+		}
+		s.restore(entries, rehash)
+	}
+}
+
+// restore puts entries read from disk into s.
+//
+// Entries expired while the data was stored are skipped.
+// Keys are hashed again by s.hasher if rehash is set.
+func (s *Storage) restore(entries []entry, rehash bool) {
+	now := time.Now().UnixNano()
+	for _, e := range entries {
+		if e.expire != 0 && e.expire <= now {
+			continue
+		}
+		if rehash {
+			e.h = s.hasher.Hash(e.k)
+		}
+		s.buckets[e.h&s.mask].put(e.k, e.v, e.h, e.expire)
+	}
+}
+
+// entry is a (k, v) pair together with its hash and expiration
+// deadline, as stored on disk.
+type entry struct {
+	h      uint64
+	expire int64
+	k      []byte
+	v      []byte
+}
+
+// marshal appends a bucket record to dst and returns the result.
+//
+// Record layout (all integers are little-endian uint64):
+//
+//	entriesCount
+//	entriesCount * (hash, expire, len(k), len(v), k, v)
+//	xxh3 checksum of everything above
+//
+// The bucket is locked only for capturing a snapshot of its entries,
+// so writers aren't blocked while the entries are encoded.
+func (b *bucket) marshal(dst []byte, entries []entry) ([]byte, []entry) {
+	entries = b.snapshot(entries[:0])
+	dst = marshalEntries(dst, entries)
+	b.releaseSnapshot()
+	// Do not keep references to the bucket memory.
+	clear(entries)
+	return dst, entries
+}
+
+func marshalEntries(dst []byte, entries []entry) []byte {
+	start := len(dst)
+	dst = appendUint64(dst, uint64(len(entries)))
+	for _, e := range entries {
+		dst = appendUint64(dst, e.h)
+		dst = appendUint64(dst, uint64(e.expire))
+		dst = appendUint64(dst, uint64(len(e.k)))
+		dst = appendUint64(dst, uint64(len(e.v)))
+		dst = append(dst, e.k...)
+		dst = append(dst, e.v...)
+	}
+	return appendUint64(dst, xxh3.Hash(dst[start:]))
+}
+
+// readBucket reads a single record written by bucket.marshal from r.
+//
+// maxLen limits the length of keys and values, so a corrupted length
+// is reported before the checksum is verified.
+func readBucket(r io.Reader, maxLen uint64) ([]entry, error) {
+	h := xxh3.New()
+	tr := io.TeeReader(r, h)
+	n, err := readUint64(tr)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxLen/(3*8) {
+		return nil, fmt.Errorf("too big entriesCount=%d", n)
+	}
+	entries := make([]entry, 0, min(n, 1024))
+	for i := uint64(0); i < n; i++ {
+		entries = append(entries, entry{})
+		e := &entries[i]
+		if e.h, err = readUint64(tr); err != nil {
+			return nil, fmt.Errorf("cannot read hash: %w", unexpectedEOF(err))
+		}
+		expire, err := readUint64(tr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read expire: %w", unexpectedEOF(err))
+		}
+		e.expire = int64(expire)
+		kLen, err := readUint64(tr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key length: %w", unexpectedEOF(err))
+		}
+		vLen, err := readUint64(tr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read value length: %w", unexpectedEOF(err))
+		}
+		if kLen > maxLen || vLen > maxLen {
+			return nil, fmt.Errorf("too big entry; len(k)=%d, len(v)=%d", kLen, vLen)
+		}
+		kv, err := readBytes(tr, kLen+vLen)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read entry: %w", unexpectedEOF(err))
+		}
+		e.k, e.v = kv[:kLen:kLen], kv[kLen:]
+	}
+	sum, err := readUint64(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read checksum: %w", unexpectedEOF(err))
+	}
+	if sum != h.Sum64() {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return entries, nil
+}
+
+// readBytes reads n bytes from r.
+//
+// Big reads are done in chunks, so the memory is allocated only
+// for the data actually present in r.
+func readBytes(r io.Reader, n uint64) ([]byte, error) {
+	const chunkSize = 64 * 1024
+	if n <= chunkSize {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	var bb bytes.Buffer
+	bb.Grow(chunkSize)
+	if _, err := io.CopyN(&bb, r, int64(n)); err != nil {
+		return nil, err
+	}
+	return bb.Bytes(), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func appendUint64(dst []byte, u uint64) []byte {
+	return binary.LittleEndian.AppendUint64(dst, u)
+}
+
+func readUint64(r io.Reader) (uint64, error) {
+	var u64Buf [8]byte
+	if _, err := io.ReadFull(r, u64Buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(u64Buf[:]), nil
+}
@@ -0,0 +1,195 @@
+package bytestorage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveLoadSmall(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "TestSaveLoadSmall.bytestorage")
+
+	s := New()
+	defer s.Reset()
+
+	key := []byte("foobar")
+	value := []byte("abcdef")
+	s.Set(key, value)
+	if err := s.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	s1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	vv := s1.Get(nil, key)
+	if string(vv) != string(value) {
+		t.Fatalf("unexpected value obtained from storage; got %q; want %q", vv, value)
+	}
+
+	// Verify that key can be overwritten.
+	newValue := []byte("234fdfd")
+	s1.Set(key, newValue)
+	vv = s1.Get(nil, key)
+	if string(vv) != string(newValue) {
+		t.Fatalf("unexpected new value obtained from storage; got %q; want %q", vv, newValue)
+	}
+}
+
+func TestSaveLoadFile(t *testing.T) {
+	for _, concurrency := range []int{0, 1, 2, 4, 10} {
+		t.Run(fmt.Sprintf("concurrency_%d", concurrency), func(t *testing.T) {
+			testSaveLoadFile(t, concurrency)
+		})
+	}
+}
+
+func testSaveLoadFile(t *testing.T, concurrency int) {
+	filePath := filepath.Join(t.TempDir(), fmt.Sprintf("TestSaveLoadFile.%d.bytestorage", concurrency))
+
+	const itemsCount = 10000
+	s := New()
+	for i := 0; i < itemsCount; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := []byte(fmt.Sprintf("value %d", i))
+		s.Set(k, v)
+	}
+	// Deleted entries must not be saved.
+	for i := 0; i < itemsCount; i += 10 {
+		s.Del([]byte(fmt.Sprintf("key %d", i)))
+	}
+	if err := s.SaveToFileConcurrent(filePath, concurrency); err != nil {
+		t.Fatalf("SaveToFileConcurrent(%d) error: %s", concurrency, err)
+	}
+	size := s.Size()
+	s.Reset()
+
+	s1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer s1.Reset()
+	for i := 0; i < itemsCount; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		vv, exist := s1.HasGet(nil, k)
+		if i%10 == 0 {
+			if exist {
+				t.Fatalf("unexpected deleted key %q loaded with value %q", k, vv)
+			}
+			continue
+		}
+		v := fmt.Sprintf("value %d", i)
+		if string(vv) != v {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, vv, v)
+		}
+	}
+	if n := s1.EntriesCount(); n != itemsCount-itemsCount/10 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, itemsCount-itemsCount/10)
+	}
+	if s1.Size() != size {
+		t.Fatalf("unexpected size; got %d; want %d", s1.Size(), size)
+	}
+	var stats Stats
+	s1.UpdateStats(&stats)
+	if stats.SetCalls != 0 {
+		t.Fatalf("unexpected SetCalls after load; got %d; want 0", stats.SetCalls)
+	}
+}
+
+func TestSaveLoadCollision(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "TestSaveLoadCollision.bytestorage")
+
+	s := New()
+	defer s.Reset()
+	s.colSet([]byte("aaa"), []byte("bbb"), brokenHash)
+	s.colSet([]byte("bbb"), []byte("ccc"), brokenHash)
+	s.colSet([]byte("ccc"), []byte("ddd"), brokenHash)
+	s.colSet([]byte("ddd"), []byte("eee"), brokenHash2)
+	s.Set([]byte("eee"), []byte("fff"))
+	if err := s.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	s1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	defer s1.Reset()
+	for _, kv := range [][3]string{{"aaa", "bbb"}, {"bbb", "ccc"}, {"ccc", "ddd"}} {
+		if v := s1.colGet(nil, []byte(kv[0]), brokenHash); string(v) != kv[1] {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", kv[0], v, kv[1])
+		}
+	}
+	if v := s1.colGet(nil, []byte("ddd"), brokenHash2); string(v) != "eee" {
+		t.Fatalf("unexpected value for key %q; got %q; want %q", "ddd", v, "eee")
+	}
+	if v := s1.Get(nil, []byte("eee")); string(v) != "fff" {
+		t.Fatalf("unexpected value for key %q; got %q; want %q", "eee", v, "fff")
+	}
+	if n := s1.EntriesCount(); n != 5 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, 5)
+	}
+
+	// Collision chain must still be consistent after load.
+	s1.colDel([]byte("bbb"), brokenHash)
+	s1.colDel([]byte("aaa"), brokenHash)
+	if v := s1.colGet(nil, []byte("ccc"), brokenHash); string(v) != "ddd" {
+		t.Fatalf("unexpected value for key %q; got %q; want %q", "ccc", v, "ddd")
+	}
+}
+
+func TestLoadCorrupted(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "TestLoadCorrupted.bytestorage")
+
+	s := New()
+	defer s.Reset()
+	for i := 0; i < 1000; i++ {
+		s.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	if err := s.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	dataPath := filepath.Join(filePath, "data.0.bin")
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte inside the data.
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	if err := os.WriteFile(dataPath, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFromFile(filePath); err == nil {
+		t.Fatalf("expecting non-nil error when loading corrupted data")
+	}
+
+	// Truncate the data.
+	if err := os.WriteFile(dataPath, data[:len(data)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFromFile(filePath); err == nil {
+		t.Fatalf("expecting non-nil error when loading truncated data")
+	}
+	if s1 := LoadFromFileOrNew(filePath); s1.EntriesCount() != 0 {
+		t.Fatalf("expecting empty storage from LoadFromFileOrNew")
+	}
+
+	// Broken metadata.
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFromFile(filePath); err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(filePath, "metadata.bin"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFromFile(filePath); err == nil {
+		t.Fatalf("expecting non-nil error when loading broken metadata")
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/kiriklo/bytestorage
 
-go 1.21.3
+go 1.23
 
 require (
 	github.com/VictoriaMetrics/fastcache v1.12.2
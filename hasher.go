@@ -0,0 +1,145 @@
+package bytestorage
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/xxh3"
+)
+
+// Hasher computes 64-bit hashes of keys.
+//
+// The hash selects the bucket and identifies the key inside the bucket,
+// so keys with equal hashes are slower to access. Hash must be safe
+// for concurrent use and must return the same value for the same key
+// during the storage lifetime.
+type Hasher interface {
+	Hash(k []byte) uint64
+}
+
+// HasherFunc adapts an ordinary function to the Hasher interface.
+//
+// It may be used for plugging in a hash precomputed by the caller.
+type HasherFunc func(k []byte) uint64
+
+// Hash returns f(k).
+func (f HasherFunc) Hash(k []byte) uint64 {
+	return f(k)
+}
+
+// XXH3Hasher hashes keys with unseeded xxh3.
+//
+// Hashes are the same in all the processes, so keys colliding in one bucket
+// may be precomputed. Don't use it for keys controlled by untrusted parties.
+type XXH3Hasher struct{}
+
+// Hash returns xxh3 hash of k.
+func (XXH3Hasher) Hash(k []byte) uint64 {
+	return xxh3.Hash(k)
+}
+
+// SeededXXH3Hasher hashes keys with xxh3 using Seed.
+//
+// It is the default Hasher with a random seed chosen for every storage.
+type SeededXXH3Hasher struct {
+	Seed uint64
+}
+
+// Hash returns xxh3 hash of k with h.Seed.
+func (h SeededXXH3Hasher) Hash(k []byte) uint64 {
+	return xxh3.HashSeed(k, h.Seed)
+}
+
+// XXHashHasher hashes keys with xxhash.
+type XXHashHasher struct{}
+
+// Hash returns xxhash hash of k.
+func (XXHashHasher) Hash(k []byte) uint64 {
+	return xxhash.Sum64(k)
+}
+
+// MapHasher hashes keys with hash/maphash.
+//
+// Create it with NewMapHasher.
+type MapHasher struct {
+	seed maphash.Seed
+}
+
+// NewMapHasher returns MapHasher with a random seed.
+//
+// The seed can't be saved, so keys of storage saved with MapHasher
+// are always hashed again on load and on write-ahead log replay.
+// Data loaded without Options.Hasher gets a new MapHasher.
+func NewMapHasher() MapHasher {
+	return MapHasher{seed: maphash.MakeSeed()}
+}
+
+// Hash returns maphash hash of k.
+func (h MapHasher) Hash(k []byte) uint64 {
+	return maphash.Bytes(h.seed, k)
+}
+
+// Kinds of hashers recorded in saved data and in the write-ahead log.
+const (
+	// Hasher set by the caller, which can't be recreated on load.
+	hasherCustom uint64 = iota
+	hasherXXH3
+	hasherSeededXXH3
+	hasherXXHash
+
+	// MapHasher, whose seed isn't recorded.
+	hasherMap
+)
+
+// hasherID identifies a built-in Hasher, so it may be recreated on load.
+type hasherID struct {
+	kind uint64
+	seed uint64
+}
+
+// idOf returns the id of h.
+func idOf(h Hasher) hasherID {
+	switch h := h.(type) {
+	case XXH3Hasher:
+		return hasherID{kind: hasherXXH3}
+	case SeededXXH3Hasher:
+		return hasherID{kind: hasherSeededXXH3, seed: h.Seed}
+	case XXHashHasher:
+		return hasherID{kind: hasherXXHash}
+	case MapHasher:
+		return hasherID{kind: hasherMap}
+	default:
+		return hasherID{kind: hasherCustom}
+	}
+}
+
+// hasher returns Hasher with the given id or nil for custom hasher.
+func (id hasherID) hasher() Hasher {
+	switch id.kind {
+	case hasherXXH3:
+		return XXH3Hasher{}
+	case hasherSeededXXH3:
+		return SeededXXH3Hasher{Seed: id.seed}
+	case hasherXXHash:
+		return XXHashHasher{}
+	case hasherMap:
+		return NewMapHasher()
+	default:
+		return nil
+	}
+}
+
+// randomSeed returns a random seed for the default hasher.
+//
+// Keys of different storages collide differently, so an attacker
+// can't precompute keys with the same hash.
+func randomSeed() uint64 {
+	var buf [8]byte
+	if _, err := cryptorand.Read(buf[:]); err != nil {
+		panic(fmt.Errorf("BUG: cannot read random seed: %w", err))
+	}
+	return binary.LittleEndian.Uint64(buf[:])
+}
@@ -0,0 +1,283 @@
+package bytestorage
+
+import (
+	"bytes"
+	"fmt"
+	"hash/maphash"
+	"path/filepath"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/xxh3"
+)
+
+func testHashers() map[string]Hasher {
+	return map[string]Hasher{
+		"xxh3":        XXH3Hasher{},
+		"seeded_xxh3": SeededXXH3Hasher{Seed: 42},
+		"xxhash":      XXHashHasher{},
+		"maphash":     NewMapHasher(),
+		// All the keys collide.
+		"func": HasherFunc(func(k []byte) uint64 { return brokenHash }),
+	}
+}
+
+func TestHashers(t *testing.T) {
+	k := []byte("key")
+	if h := (XXH3Hasher{}).Hash(k); h != xxh3.Hash(k) {
+		t.Fatalf("unexpected xxh3 hash; got %d; want %d", h, xxh3.Hash(k))
+	}
+	if h := (SeededXXH3Hasher{Seed: 42}).Hash(k); h != xxh3.HashSeed(k, 42) {
+		t.Fatalf("unexpected seeded xxh3 hash; got %d; want %d", h, xxh3.HashSeed(k, 42))
+	}
+	if h := (XXHashHasher{}).Hash(k); h != xxhash.Sum64(k) {
+		t.Fatalf("unexpected xxhash hash; got %d; want %d", h, xxhash.Sum64(k))
+	}
+	mh := NewMapHasher()
+	if h := mh.Hash(k); h != maphash.Bytes(mh.seed, k) {
+		t.Fatalf("unexpected maphash hash; got %d; want %d", h, maphash.Bytes(mh.seed, k))
+	}
+
+	for name, hasher := range testHashers() {
+		t.Run(name, func(t *testing.T) {
+			s := NewWithOptions(Options{Hasher: hasher})
+			defer s.Reset()
+
+			const itemsCount = 1000
+			for i := 0; i < itemsCount; i++ {
+				k := []byte(fmt.Sprintf("key %d", i))
+				s.Set(k, k)
+			}
+			for i := 0; i < itemsCount; i += 2 {
+				s.Del([]byte(fmt.Sprintf("key %d", i)))
+			}
+			for i := 0; i < itemsCount; i++ {
+				k := []byte(fmt.Sprintf("key %d", i))
+				v, exist := s.HasGet(nil, k)
+				if i%2 == 0 {
+					if exist || s.Has(k) {
+						t.Fatalf("unexpected deleted key %q with value %q", k, v)
+					}
+					continue
+				}
+				if !s.Has(k) || string(v) != string(k) {
+					t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, k)
+				}
+			}
+			if n := s.EntriesCount(); n != itemsCount/2 {
+				t.Fatalf("unexpected entries count; got %d; want %d", n, itemsCount/2)
+			}
+		})
+	}
+}
+
+func TestHasherPersistence(t *testing.T) {
+	opts := Options{Hasher: SeededXXH3Hasher{Seed: 42}, BucketsCount: 16}
+	s := NewWithOptions(opts)
+	defer s.Reset()
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, k)
+	}
+
+	filePath := filepath.Join(t.TempDir(), "TestHasherPersistence.bytestorage")
+	if err := s.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	s1, err := LoadFromFileWithOptions(filePath, Options{Hasher: opts.Hasher})
+	if err != nil {
+		t.Fatalf("LoadFromFileWithOptions error: %s", err)
+	}
+	var bb bytes.Buffer
+	if err := s.Snapshot(&bb); err != nil {
+		t.Fatalf("Snapshot error: %s", err)
+	}
+	s2, err := LoadSnapshotWithOptions(&bb, opts)
+	if err != nil {
+		t.Fatalf("LoadSnapshotWithOptions error: %s", err)
+	}
+	for _, s := range []*Storage{s1, s2} {
+		if n := len(s.buckets); n != 16 {
+			t.Fatalf("unexpected buckets count; got %d; want %d", n, 16)
+		}
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("key %d", i))
+			if v := s.Get(nil, k); string(v) != string(k) {
+				t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, k)
+			}
+		}
+	}
+}
+
+func TestHasherDefaultSeed(t *testing.T) {
+	s1 := New()
+	s2 := New()
+	h1, ok1 := s1.hasher.(SeededXXH3Hasher)
+	h2, ok2 := s2.hasher.(SeededXXH3Hasher)
+	if !ok1 || !ok2 {
+		t.Fatalf("unexpected default hashers; got %T, %T; want %T", s1.hasher, s2.hasher, SeededXXH3Hasher{})
+	}
+	if h1.Seed == h2.Seed {
+		t.Fatalf("storages must get distinct seeds; got %d", h1.Seed)
+	}
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s1.Set(k, k)
+	}
+
+	// The seed is saved together with the data.
+	filePath := filepath.Join(t.TempDir(), "TestHasherDefaultSeed.bytestorage")
+	if err := s1.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	s3, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	var bb bytes.Buffer
+	if err := s1.Snapshot(&bb); err != nil {
+		t.Fatalf("Snapshot error: %s", err)
+	}
+	s4, err := LoadSnapshot(&bb)
+	if err != nil {
+		t.Fatalf("LoadSnapshot error: %s", err)
+	}
+	for _, s := range []*Storage{s3, s4} {
+		if s.hasher != s1.hasher {
+			t.Fatalf("unexpected hasher; got %v; want %v", s.hasher, s1.hasher)
+		}
+		checkKeys(t, s, 100)
+	}
+
+	// Keys are hashed again when loaded with another hasher.
+	s5, err := LoadFromFileWithOptions(filePath, Options{Hasher: XXHashHasher{}})
+	if err != nil {
+		t.Fatalf("LoadFromFileWithOptions error: %s", err)
+	}
+	checkKeys(t, s5, 100)
+}
+
+func TestHasherCustomLoad(t *testing.T) {
+	hasher := HasherFunc(xxhash.Sum64)
+	s := NewWithOptions(Options{Hasher: hasher})
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, k)
+	}
+	var bb bytes.Buffer
+	if err := s.Snapshot(&bb); err != nil {
+		t.Fatalf("Snapshot error: %s", err)
+	}
+	data := bb.Bytes()
+	if _, err := LoadSnapshot(bytes.NewReader(data)); err == nil {
+		t.Fatalf("expecting non-nil error when loading data saved with custom hasher")
+	}
+	s1, err := LoadSnapshotWithOptions(bytes.NewReader(data), Options{Hasher: hasher})
+	if err != nil {
+		t.Fatalf("LoadSnapshotWithOptions error: %s", err)
+	}
+	checkKeys(t, s1, 100)
+}
+
+func TestHasherMapLoad(t *testing.T) {
+	tmpDir := t.TempDir()
+	walDir := filepath.Join(tmpDir, "wal")
+	w, err := OpenWAL(walDir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	s := NewWithOptions(Options{Hasher: NewMapHasher()})
+	s.AttachWAL(w)
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, k)
+	}
+	s.AttachWAL(nil)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	filePath := filepath.Join(tmpDir, "TestHasherMapLoad.bytestorage")
+	if err := s.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+
+	// The seed of MapHasher isn't saved, so keys are hashed again.
+	s1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	if _, ok := s1.hasher.(MapHasher); !ok {
+		t.Fatalf("unexpected hasher; got %T; want %T", s1.hasher, MapHasher{})
+	}
+	s2, err := LoadFromFileWithOptions(filePath, Options{Hasher: NewMapHasher()})
+	if err != nil {
+		t.Fatalf("LoadFromFileWithOptions error: %s", err)
+	}
+	w, err = OpenWAL(walDir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	defer w.Close()
+	s3 := NewWithOptions(Options{Hasher: NewMapHasher()})
+	if err := w.Replay(s3); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+	for _, s := range []*Storage{s1, s2, s3} {
+		checkKeys(t, s, 100)
+		// Overwritten keys aren't duplicated.
+		for i := 0; i < 100; i++ {
+			k := []byte(fmt.Sprintf("key %d", i))
+			s.Set(k, k)
+		}
+		checkKeys(t, s, 100)
+	}
+}
+
+func TestHasherLongCollisionChains(t *testing.T) {
+	s := NewWithOptions(Options{Hasher: HasherFunc(func(k []byte) uint64 { return brokenHash })})
+	defer s.Reset()
+
+	var stats Stats
+	for i := 0; i < longChainLen; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, k)
+	}
+	s.UpdateStats(&stats)
+	if stats.LongCollisionChains != 0 || stats.MaxCollisionChain != longChainLen {
+		t.Fatalf("unexpected stats; got LongCollisionChains=%d, MaxCollisionChain=%d; want %d, %d",
+			stats.LongCollisionChains, stats.MaxCollisionChain, 0, longChainLen)
+	}
+
+	k := []byte("one more key")
+	s.Set(k, k)
+	stats.Reset()
+	s.UpdateStats(&stats)
+	if stats.LongCollisionChains != 1 || stats.MaxCollisionChain != longChainLen+1 {
+		t.Fatalf("unexpected stats; got LongCollisionChains=%d, MaxCollisionChain=%d; want %d, %d",
+			stats.LongCollisionChains, stats.MaxCollisionChain, 1, longChainLen+1)
+	}
+
+	s.Del(k)
+	stats.Reset()
+	s.UpdateStats(&stats)
+	if stats.LongCollisionChains != 0 || stats.MaxCollisionChain != longChainLen {
+		t.Fatalf("unexpected stats; got LongCollisionChains=%d, MaxCollisionChain=%d; want %d, %d",
+			stats.LongCollisionChains, stats.MaxCollisionChain, 0, longChainLen)
+	}
+	checkBuckets(t, s)
+}
+
+// checkKeys verifies that s contains keys "key 0" ... "key n-1"
+// with values equal to keys.
+func checkKeys(t *testing.T, s *Storage, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if v := s.Get(nil, k); string(v) != string(k) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, k)
+		}
+	}
+	if c := s.EntriesCount(); c != uint64(n) {
+		t.Fatalf("unexpected entries count; got %d; want %d", c, n)
+	}
+}
@@ -0,0 +1,71 @@
+package bytestorage
+
+import "iter"
+
+// All returns an iterator over all the (k, v) entries in the storage.
+//
+// The iterator has the same consistency model as Storage.Range.
+// k and v are views into the storage memory, which are valid only until
+// the next iteration and must not be modified. Use Storage.AllCopies
+// for retaining them.
+func (s *Storage) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func(k, v []byte) bool) {
+		s.Range(yield)
+	}
+}
+
+// Keys returns an iterator over all the keys in the storage.
+//
+// See Storage.All for details.
+func (s *Storage) Keys() iter.Seq[[]byte] {
+	return func(yield func(k []byte) bool) {
+		s.Range(func(k, _ []byte) bool {
+			return yield(k)
+		})
+	}
+}
+
+// Values returns an iterator over all the values in the storage.
+//
+// See Storage.All for details.
+func (s *Storage) Values() iter.Seq[[]byte] {
+	return func(yield func(v []byte) bool) {
+		s.Range(func(_, v []byte) bool {
+			return yield(v)
+		})
+	}
+}
+
+// AllCopies works like Storage.All, but yields copies of k and v,
+// which may be retained and modified by the caller.
+func (s *Storage) AllCopies() iter.Seq2[[]byte, []byte] {
+	return func(yield func(k, v []byte) bool) {
+		s.Range(func(k, v []byte) bool {
+			// Copy k and v with a single allocation.
+			kv := make([]byte, 0, len(k)+len(v))
+			kv = append(kv, k...)
+			kv = append(kv, v...)
+			return yield(kv[:len(k):len(k)], kv[len(k):])
+		})
+	}
+}
+
+// KeysCopies works like Storage.Keys, but yields copies of keys,
+// which may be retained and modified by the caller.
+func (s *Storage) KeysCopies() iter.Seq[[]byte] {
+	return func(yield func(k []byte) bool) {
+		s.Range(func(k, _ []byte) bool {
+			return yield(append([]byte{}, k...))
+		})
+	}
+}
+
+// ValuesCopies works like Storage.Values, but yields copies of values,
+// which may be retained and modified by the caller.
+func (s *Storage) ValuesCopies() iter.Seq[[]byte] {
+	return func(yield func(v []byte) bool) {
+		s.Range(func(_, v []byte) bool {
+			return yield(append([]byte{}, v...))
+		})
+	}
+}
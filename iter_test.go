@@ -0,0 +1,126 @@
+package bytestorage
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestStorageIterators(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	const itemsCount = 1000
+	for i := 0; i < itemsCount; i++ {
+		s.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	s.colSet([]byte("aaa"), []byte("bbb"), brokenHash)
+	s.colSet([]byte("bbb"), []byte("ccc"), brokenHash)
+
+	for name, all := range map[string]func() map[string]string{
+		"All": func() map[string]string {
+			m := make(map[string]string)
+			for k, v := range s.All() {
+				m[string(k)] = string(v)
+			}
+			return m
+		},
+		"AllCopies": func() map[string]string {
+			m := make(map[string]string)
+			for k, v := range s.AllCopies() {
+				m[string(k)] = string(v)
+			}
+			return m
+		},
+	} {
+		m := all()
+		if len(m) != itemsCount+2 {
+			t.Fatalf("%s: unexpected number of entries; got %d; want %d", name, len(m), itemsCount+2)
+		}
+		for i := 0; i < itemsCount; i++ {
+			k, v := fmt.Sprintf("key %d", i), fmt.Sprintf("value %d", i)
+			if m[k] != v {
+				t.Fatalf("%s: unexpected value for key %q; got %q; want %q", name, k, m[k], v)
+			}
+		}
+		if m["aaa"] != "bbb" || m["bbb"] != "ccc" {
+			t.Fatalf("%s: unexpected collided entries; got %q, %q; want %q, %q", name, m["aaa"], m["bbb"], "bbb", "ccc")
+		}
+	}
+
+	var keys, values, keysCopies, valuesCopies []string
+	for k := range s.Keys() {
+		keys = append(keys, string(k))
+	}
+	for v := range s.Values() {
+		values = append(values, string(v))
+	}
+	for k := range s.KeysCopies() {
+		keysCopies = append(keysCopies, string(k))
+	}
+	for v := range s.ValuesCopies() {
+		valuesCopies = append(valuesCopies, string(v))
+	}
+	for _, ss := range [][]string{keys, values, keysCopies, valuesCopies} {
+		if len(ss) != itemsCount+2 {
+			t.Fatalf("unexpected number of items; got %d; want %d", len(ss), itemsCount+2)
+		}
+		sort.Strings(ss)
+	}
+	if fmt.Sprint(keys) != fmt.Sprint(keysCopies) || fmt.Sprint(values) != fmt.Sprint(valuesCopies) {
+		t.Fatalf("copies differ from views")
+	}
+}
+
+func TestStorageIteratorsBreak(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, k)
+	}
+	n := 0
+	for range s.All() {
+		n++
+		if n == 10 {
+			break
+		}
+	}
+	if n != 10 {
+		t.Fatalf("unexpected number of visited entries; got %d; want %d", n, 10)
+	}
+	for i := range s.buckets {
+		if s.buckets[i].snapshots.Load() != 0 {
+			t.Fatalf("bucket %d isn't released after break", i)
+		}
+	}
+}
+
+func TestStorageIteratorsCopies(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, []byte("value 1"))
+	}
+
+	// Copies stay unchanged after the values are overwritten in place.
+	var keys, values [][]byte
+	for k, v := range s.AllCopies() {
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	for _, k := range keys {
+		s.Set(k, []byte("value 2"))
+	}
+	for i, v := range values {
+		if string(v) != "value 1" {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", keys[i], v, "value 1")
+		}
+	}
+	for v := range s.ValuesCopies() {
+		if string(v) != "value 2" {
+			t.Fatalf("unexpected value; got %q; want %q", v, "value 2")
+		}
+	}
+}
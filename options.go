@@ -0,0 +1,121 @@
+package bytestorage
+
+// Maximum number of buckets in storage.
+const maxBucketsCount = 1 << 24
+
+// Options contains options for NewWithOptions.
+//
+// Zero fields are replaced with the defaults used by New.
+type Options struct {
+	// BucketsCount is the number of buckets in storage.
+	//
+	// It is rounded up to a power of two, so a bucket is selected by
+	// masking the key hash. The maximum is 1<<24. Default is 512.
+	//
+	// Buckets are locked separately, so fewer buckets mean more
+	// contention between concurrent writers. The number of buckets
+	// is reduced for small Limits.
+	BucketsCount int
+
+	// EntriesCount is the number of entries pre-allocated in every bucket.
+	//
+	// Default is 16.
+	EntriesCount int
+
+	// EntrySize is the initial capacity of every pre-allocated key and value.
+	//
+	// Default is 8.
+	EntrySize int
+
+	// ExpectedEntries is the expected number of entries in storage.
+	//
+	// It is used for sizing bucket maps, so they don't grow
+	// while storage is filled.
+	ExpectedEntries int
+
+	// LazyInit delays memory allocation of every bucket
+	// until the first write to it.
+	//
+	// It makes small storages cheap, since unused buckets cost nothing.
+	LazyInit bool
+
+	// Limits bounds the storage size. See NewBounded.
+	Limits Limits
+
+	// BucketStats enables Stats.BucketStats.
+	//
+	// Time spent waiting for bucket locks is measured only then,
+	// since it costs a clock read on every contended lock.
+	BucketStats bool
+
+	// Hasher computes hashes of keys.
+	//
+	// Default is SeededXXH3Hasher with a random seed, so keys colliding
+	// in one storage don't collide in another one. Built-in hashers
+	// are saved together with storage data, MapHasher without its seed.
+	// Storage with another Hasher must be loaded with the same Hasher
+	// via LoadFromFileWithOptions or LoadSnapshotWithOptions.
+	//
+	// Use XXH3Hasher only if keys can't be chosen by an attacker,
+	// see Stats.LongCollisionChains.
+	Hasher Hasher
+}
+
+// bucketOptions contains the initial sizes shared by all the storage buckets.
+type bucketOptions struct {
+	entriesCount int
+	entriesSize  int
+	mapSize      int
+	lazy         bool
+	bucketStats  bool
+}
+
+// NewWithOptions returns new Storage configured with the given opts.
+func NewWithOptions(opts Options) *Storage {
+	n := uint64(bucketsCount)
+	if opts.BucketsCount > 0 {
+		n = 1
+		for n < uint64(opts.BucketsCount) && n < maxBucketsCount {
+			n <<= 1
+		}
+	}
+	n = limitBuckets(n, opts.Limits)
+	bo := &bucketOptions{
+		entriesCount: entriesCount,
+		entriesSize:  entriesSize,
+		lazy:         opts.LazyInit,
+		bucketStats:  opts.BucketStats,
+	}
+	if opts.EntriesCount > 0 {
+		bo.entriesCount = opts.EntriesCount
+	}
+	if opts.EntrySize > 0 {
+		bo.entriesSize = opts.EntrySize
+	}
+	bo.mapSize = bo.entriesCount
+	if m := (uint64(opts.ExpectedEntries) + n - 1) / n; opts.ExpectedEntries > 0 && m > uint64(bo.mapSize) {
+		bo.mapSize = int(m)
+	}
+
+	hasher := opts.Hasher
+	if hasher == nil {
+		hasher = SeededXXH3Hasher{Seed: randomSeed()}
+	}
+
+	l := opts.Limits
+	s := &Storage{
+		buckets: make([]bucket, n),
+		mask:    n - 1,
+		hasher:  hasher,
+	}
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		b.opts = bo
+		b.ev.maxBytes = limitShare(l.MaxBytes, n, uint64(i))
+		b.ev.maxEntries = limitShare(l.MaxEntries, n, uint64(i))
+		b.ev.policy = l.Policy
+		b.ev.tinyLFU = l.TinyLFU
+		b.init()
+	}
+	return s
+}
@@ -0,0 +1,159 @@
+package bytestorage
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{BucketsCount: 1},
+		{BucketsCount: 3, EntriesCount: 1, EntrySize: 1},
+		{BucketsCount: 64, ExpectedEntries: 100000},
+		{BucketsCount: 16, LazyInit: true},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			s := NewWithOptions(opts)
+			defer s.Reset()
+
+			n := len(s.buckets)
+			if n&(n-1) != 0 || n < opts.BucketsCount || s.mask != uint64(n-1) {
+				t.Fatalf("unexpected buckets count %d with mask %d", n, s.mask)
+			}
+			const itemsCount = 10000
+			for i := 0; i < itemsCount; i++ {
+				k := []byte(fmt.Sprintf("key %d", i))
+				s.Set(k, k)
+			}
+			for i := 0; i < itemsCount; i += 2 {
+				s.Del([]byte(fmt.Sprintf("key %d", i)))
+			}
+			s.colSet([]byte("aaa"), []byte("bbb"), brokenHash)
+			s.colSet([]byte("bbb"), []byte("ccc"), brokenHash)
+			for i := 1; i < itemsCount; i += 2 {
+				k := []byte(fmt.Sprintf("key %d", i))
+				if v := s.Get(nil, k); string(v) != string(k) {
+					t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, k)
+				}
+			}
+			if v := s.colGet(nil, []byte("aaa"), brokenHash); string(v) != "bbb" {
+				t.Fatalf("unexpected value obtained; got %q; want %q", v, "bbb")
+			}
+			if n := s.EntriesCount(); n != itemsCount/2+2 {
+				t.Fatalf("unexpected entries count; got %d; want %d", n, itemsCount/2+2)
+			}
+		})
+	}
+}
+
+func TestNewWithOptionsLazyInit(t *testing.T) {
+	s := NewWithOptions(Options{LazyInit: true})
+	for i := range s.buckets {
+		if s.buckets[i].kv != nil {
+			t.Fatalf("bucket %d is allocated before the first write", i)
+		}
+	}
+
+	// Reads and deletes don't allocate buckets.
+	k := []byte("key")
+	if s.Has(k) {
+		t.Fatalf("unexpected key %q", k)
+	}
+	if v, exist := s.HasGet(nil, k); exist || len(v) != 0 {
+		t.Fatalf("unexpected value obtained; got %q", v)
+	}
+	if _, exist := s.TTL(k); exist {
+		t.Fatalf("unexpected ttl obtained for missing key")
+	}
+	s.Del(k)
+	s.sweep(sweepSize)
+	s.Range(func(k, v []byte) bool {
+		t.Fatalf("unexpected entry (%q, %q)", k, v)
+		return true
+	})
+	var bb bytes.Buffer
+	if err := s.Snapshot(&bb); err != nil {
+		t.Fatalf("Snapshot error: %s", err)
+	}
+
+	s.SetWithTTL(k, []byte("value"), time.Hour)
+	allocated := 0
+	for i := range s.buckets {
+		if s.buckets[i].kv != nil {
+			allocated++
+		}
+	}
+	if allocated != 1 {
+		t.Fatalf("unexpected number of allocated buckets; got %d; want %d", allocated, 1)
+	}
+	if v := s.Get(nil, k); string(v) != "value" {
+		t.Fatalf("unexpected value obtained; got %q; want %q", v, "value")
+	}
+
+	// Reset drops the memory.
+	s.Reset()
+	if b := &s.buckets[s.hasher.Hash(k)&s.mask]; b.kv != nil {
+		t.Fatalf("bucket is allocated after reset")
+	}
+	if s.Has(k) {
+		t.Fatalf("unexpected key %q after reset", k)
+	}
+}
+
+func TestNewWithOptionsPersistence(t *testing.T) {
+	s := NewWithOptions(Options{BucketsCount: 8, LazyInit: true})
+	defer s.Reset()
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, k)
+	}
+
+	filePath := filepath.Join(t.TempDir(), "TestNewWithOptionsPersistence.bytestorage")
+	if err := s.SaveToFileConcurrent(filePath, 4); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	s1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	var bb bytes.Buffer
+	if err := s.Snapshot(&bb); err != nil {
+		t.Fatalf("Snapshot error: %s", err)
+	}
+	s2, err := LoadSnapshot(&bb)
+	if err != nil {
+		t.Fatalf("LoadSnapshot error: %s", err)
+	}
+	for _, s := range []*Storage{s1, s2} {
+		if n := len(s.buckets); n != 8 {
+			t.Fatalf("unexpected buckets count; got %d; want %d", n, 8)
+		}
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("key %d", i))
+			if v := s.Get(nil, k); string(v) != string(k) {
+				t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, k)
+			}
+		}
+	}
+}
+
+func TestNewWithOptionsBounded(t *testing.T) {
+	s := NewWithOptions(Options{
+		BucketsCount: 4,
+		LazyInit:     true,
+		Limits:       Limits{MaxEntries: 100, Policy: EvictClock, TinyLFU: true},
+	})
+	defer s.Reset()
+	for i := 0; i < 10000; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, k)
+	}
+	checkBuckets(t, s)
+	if n := s.EntriesCount(); n > 100 {
+		t.Fatalf("too many entries; got %d; want at most %d", n, 100)
+	}
+}
@@ -0,0 +1,40 @@
+package bytestorage
+
+// Range calls fn for every entry in the storage until fn returns false.
+//
+// Every bucket is captured atomically like in Storage.Snapshot, but buckets
+// are captured one after another. So Range doesn't see a consistent image
+// of the whole storage: entries set or deleted in other buckets during Range
+// may or may not be visited. Every entry is visited at most once.
+//
+// No lock is held while fn is called, so fn may read and modify the storage.
+// k and v are valid only until fn returns and must not be modified.
+func (s *Storage) Range(fn func(k, v []byte) bool) {
+	var entries []entry
+	for i := range s.buckets {
+		var ok bool
+		entries, ok = s.buckets[i].rangeEntries(entries[:0], fn)
+		if !ok {
+			return
+		}
+	}
+}
+
+// rangeEntries calls fn for every bucket entry until fn returns false.
+//
+// dst is used as a buffer for entry references and is returned
+// for re-use.
+func (b *bucket) rangeEntries(dst []entry, fn func(k, v []byte) bool) ([]entry, bool) {
+	dst = b.snapshot(dst)
+	defer func() {
+		b.releaseSnapshot()
+		// Drop references, so the memory may be collected.
+		clear(dst)
+	}()
+	for _, e := range dst {
+		if !fn(e.k, e.v) {
+			return dst, false
+		}
+	}
+	return dst, true
+}
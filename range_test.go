@@ -0,0 +1,121 @@
+package bytestorage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStorageRange(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	const itemsCount = 10000
+	for i := 0; i < itemsCount; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, k)
+	}
+	for i := 0; i < itemsCount; i += 2 {
+		s.Del([]byte(fmt.Sprintf("key %d", i)))
+	}
+	s.colSet([]byte("aaa"), []byte("bbb"), brokenHash)
+	s.colSet([]byte("bbb"), []byte("ccc"), brokenHash)
+	s.colSet([]byte("ccc"), []byte("ddd"), brokenHash)
+	s.colDel([]byte("bbb"), brokenHash)
+	s.SetWithTTL([]byte("expired"), []byte("value"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	m := make(map[string]string)
+	s.Range(func(k, v []byte) bool {
+		if _, ok := m[string(k)]; ok {
+			t.Fatalf("key %q is visited twice", k)
+		}
+		m[string(k)] = string(v)
+		return true
+	})
+	if len(m) != itemsCount/2+2 {
+		t.Fatalf("unexpected number of visited entries; got %d; want %d", len(m), itemsCount/2+2)
+	}
+	for i := 1; i < itemsCount; i += 2 {
+		k := fmt.Sprintf("key %d", i)
+		if v := m[k]; v != k {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, k)
+		}
+	}
+	if m["aaa"] != "bbb" || m["ccc"] != "ddd" {
+		t.Fatalf("unexpected collided entries; got %q, %q; want %q, %q", m["aaa"], m["ccc"], "bbb", "ddd")
+	}
+}
+
+func TestStorageRangeStop(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, k)
+	}
+	n := 0
+	s.Range(func(k, v []byte) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("unexpected number of visited entries; got %d; want %d", n, 10)
+	}
+	for i := range s.buckets {
+		if s.buckets[i].snapshots.Load() != 0 {
+			t.Fatalf("bucket %d isn't released after Range", i)
+		}
+	}
+}
+
+func TestStorageRangeModify(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, []byte("value"))
+	}
+
+	// fn may modify the storage without changing the visited values.
+	n := 0
+	s.Range(func(k, v []byte) bool {
+		s.Set(k, []byte("new value"))
+		if string(v) != "value" {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, "value")
+		}
+		s.Del(k)
+		n++
+		return true
+	})
+	if n != 1000 {
+		t.Fatalf("unexpected number of visited entries; got %d; want %d", n, 1000)
+	}
+	if n := s.EntriesCount(); n != 0 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, 0)
+	}
+}
+
+func TestStorageRangeAppend(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	s.Set(k, []byte("foo"))
+	// Give the value spare capacity, which is used by Append.
+	b := &s.buckets[s.hasher.Hash(k)&s.mask]
+	idx, _ := b.find(k, s.hasher.Hash(k))
+	b.kv[idx][1] = append(make([]byte, 0, 64), b.kv[idx][1]...)
+
+	s.Range(func(k, v []byte) bool {
+		if cap(k) != len(k) || cap(v) != len(v) {
+			t.Fatalf("capacity must be limited; got cap(k)=%d, cap(v)=%d; want %d, %d", cap(k), cap(v), len(k), len(v))
+		}
+		_ = append(v, "bar"...)
+		return true
+	})
+	s.Append(k, []byte("baz"))
+	if v := s.Get(nil, k); string(v) != "foobaz" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "foobaz")
+	}
+}
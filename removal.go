@@ -0,0 +1,124 @@
+package bytestorage
+
+import "bytes"
+
+// RemovalReason is the reason of entry removal passed to the OnRemove callback.
+type RemovalReason int
+
+const (
+	// ReasonDeleted means the entry was deleted with Del.
+	ReasonDeleted RemovalReason = iota + 1
+
+	// ReasonReplaced means the entry value was changed with Set.
+	ReasonReplaced
+
+	// ReasonExpired means the entry ttl has passed. The entry is removed
+	// by the sweeper, replaced with Set or deleted with Del.
+	ReasonExpired
+
+	// ReasonEvicted means the entry was evicted from the bounded storage.
+	ReasonEvicted
+
+	// ReasonReset means the entry was removed with Reset.
+	ReasonReset
+)
+
+// String returns the name of r.
+func (r RemovalReason) String() string {
+	switch r {
+	case ReasonDeleted:
+		return "deleted"
+	case ReasonReplaced:
+		return "replaced"
+	case ReasonExpired:
+		return "expired"
+	case ReasonEvicted:
+		return "evicted"
+	case ReasonReset:
+		return "reset"
+	default:
+		return "unknown"
+	}
+}
+
+// OnRemove sets fn to be called for every entry leaving the storage.
+//
+// fn is called after the bucket lock is released, so it may access
+// the storage. It is called synchronously by the goroutine which removed
+// the entry, so slow fn slows down Set, Del, Reset and the sweeper.
+//
+// k and v passed to fn are detached from the storage, which never writes
+// to them again. fn may retain them, but must not modify them, since
+// they may be shared with a snapshot being written.
+//
+// Pass nil to remove the callback.
+func (s *Storage) OnRemove(fn func(k, v []byte, reason RemovalReason)) {
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		b.lock()
+		b.onRemove = fn
+		b.mu.Unlock()
+	}
+}
+
+// removal is an entry removed under the bucket lock.
+type removal struct {
+	k, v   []byte
+	reason RemovalReason
+}
+
+// unlock releases the bucket write lock and passes the removed
+// entries to onRemove.
+func (b *bucket) unlock() {
+	if len(b.removed) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	removed, fn := b.removed, b.onRemove
+	b.removed = nil
+	b.mu.Unlock()
+	for _, r := range removed {
+		fn(r.k, r.v, r.reason)
+	}
+}
+
+// detach queues kv[idx] for onRemove and drops its memory from the bucket.
+//
+// Must be called under the bucket write lock.
+func (b *bucket) detach(idx uint64, reason RemovalReason) {
+	b.removed = append(b.removed, removal{
+		k:      b.kv[idx][0],
+		v:      b.kv[idx][1],
+		reason: reason,
+	})
+	b.allocated.Add(-uint64(cap(b.kv[idx][0]) + cap(b.kv[idx][1])))
+	b.kv[idx][0] = nil
+	b.kv[idx][1] = nil
+}
+
+// replace queues kv[idx] for onRemove if its value is going to be changed to v.
+//
+// Must be called under the bucket write lock before the new expiration
+// deadline is set.
+func (b *bucket) replace(idx uint64, v []byte) {
+	if b.onRemove == nil || string(b.kv[idx][1]) == string(v) {
+		return
+	}
+	reason := b.removalReason(idx, ReasonReplaced)
+	k := b.kv[idx][0]
+	// The value is dropped from the bucket, so the new value
+	// is accounted by the caller as replacing an empty one.
+	b.size.Add(-uint64(len(b.kv[idx][1])))
+	b.detach(idx, reason)
+	b.kv[idx][0] = bytes.Clone(k)
+	b.allocated.Add(uint64(cap(b.kv[idx][0])))
+}
+
+// removalReason returns ReasonExpired if kv[idx] has expired
+// but isn't swept yet, otherwise reason.
+func (b *bucket) removalReason(idx uint64, reason RemovalReason) RemovalReason {
+	if b.expired(idx) {
+		return ReasonExpired
+	}
+	return reason
+}
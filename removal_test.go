@@ -0,0 +1,160 @@
+package bytestorage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type removed struct {
+	k, v   string
+	reason RemovalReason
+}
+
+// removalRecorder collects entries passed to OnRemove.
+type removalRecorder struct {
+	mu      sync.Mutex
+	removed []removed
+	keys    [][]byte
+}
+
+func (rr *removalRecorder) onRemove(k, v []byte, reason RemovalReason) {
+	rr.mu.Lock()
+	rr.removed = append(rr.removed, removed{string(k), string(v), reason})
+	rr.keys = append(rr.keys, k)
+	rr.mu.Unlock()
+}
+
+func (rr *removalRecorder) check(t *testing.T, want ...removed) {
+	t.Helper()
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if len(rr.removed) != len(want) {
+		t.Fatalf("unexpected removed entries; got %v; want %v", rr.removed, want)
+	}
+	for i := range want {
+		if rr.removed[i] != want[i] {
+			t.Fatalf("unexpected removed entry %d; got %v; want %v", i, rr.removed[i], want[i])
+		}
+	}
+	rr.removed = rr.removed[:0]
+	rr.keys = rr.keys[:0]
+}
+
+func TestStorageOnRemove(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	var rr removalRecorder
+	s.OnRemove(rr.onRemove)
+
+	s.Set([]byte("aaa"), []byte("bbb"))
+	s.Set([]byte("aaa"), []byte("bbb"))
+	rr.check(t)
+	s.Set([]byte("aaa"), []byte("ccc"))
+	rr.check(t, removed{"aaa", "bbb", ReasonReplaced})
+	if size := s.Size(); size != 6 {
+		t.Fatalf("unexpected size after replace; got %d; want %d", size, 6)
+	}
+	s.Del([]byte("aaa"))
+	rr.check(t, removed{"aaa", "ccc", ReasonDeleted})
+	s.Del([]byte("aaa"))
+	rr.check(t)
+
+	// Removed slices must not be reused by the storage.
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, k)
+		s.Del(k)
+		s.Set(k, []byte("overwritten"))
+	}
+	for i, k := range rr.keys {
+		if string(k) != rr.removed[i].k {
+			t.Fatalf("removed key is modified; got %q; want %q", k, rr.removed[i].k)
+		}
+	}
+	rr.keys = rr.keys[:0]
+	rr.removed = rr.removed[:0]
+
+	s.Reset()
+	if n := len(rr.removed); n != 100 {
+		t.Fatalf("unexpected number of entries removed by reset; got %d; want %d", n, 100)
+	}
+	for _, r := range rr.removed {
+		if r.reason != ReasonReset || r.v != "overwritten" {
+			t.Fatalf("unexpected removed entry %v", r)
+		}
+	}
+	rr.removed = rr.removed[:0]
+
+	s.OnRemove(nil)
+	s.Set([]byte("aaa"), []byte("bbb"))
+	s.Del([]byte("aaa"))
+	rr.check(t)
+}
+
+func TestStorageOnRemoveExpired(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	var rr removalRecorder
+	s.OnRemove(rr.onRemove)
+
+	s.SetWithTTL([]byte("aaa"), []byte("bbb"), 10*time.Millisecond)
+	s.SetWithTTL([]byte("ccc"), []byte("ddd"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	s.Set([]byte("aaa"), []byte("eee"))
+	rr.check(t, removed{"aaa", "bbb", ReasonExpired})
+	s.sweep(sweepSize)
+	rr.check(t, removed{"ccc", "ddd", ReasonExpired})
+
+	// Del of the expired entry, which isn't swept yet.
+	s.SetWithTTL([]byte("fff"), []byte("ggg"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	s.Del([]byte("fff"))
+	rr.check(t, removed{"fff", "ggg", ReasonExpired})
+}
+
+func TestStorageOnRemoveEvicted(t *testing.T) {
+	s := NewBounded(Limits{MaxEntries: bucketsCount})
+	defer s.Reset()
+	var rr removalRecorder
+	s.OnRemove(rr.onRemove)
+
+	keys := keysForBucket(s, 0, 2)
+	s.Set(keys[0], []byte("value"))
+	s.Set(keys[1], []byte("value"))
+	rr.check(t, removed{string(keys[0]), "value", ReasonEvicted})
+}
+
+func TestStorageOnRemoveCollision(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	var rr removalRecorder
+	s.OnRemove(rr.onRemove)
+
+	s.colSet([]byte("aaa"), []byte("bbb"), brokenHash)
+	s.colSet([]byte("bbb"), []byte("ccc"), brokenHash)
+	s.colSet([]byte("aaa"), []byte("ddd"), brokenHash)
+	s.colDel([]byte("bbb"), brokenHash)
+	rr.check(t, removed{"aaa", "bbb", ReasonReplaced}, removed{"bbb", "ccc", ReasonDeleted})
+	if v := s.colGet(nil, []byte("aaa"), brokenHash); string(v) != "ddd" {
+		t.Fatalf("unexpected value obtained; got %q; want %q", v, "ddd")
+	}
+}
+
+func TestStorageOnRemoveReentrant(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	// Callback is called outside the bucket lock, so it may use the storage.
+	s.OnRemove(func(k, v []byte, reason RemovalReason) {
+		if reason == ReasonDeleted {
+			s.Set(append([]byte("deleted "), k...), v)
+		}
+	})
+	s.Set([]byte("aaa"), []byte("bbb"))
+	s.Del([]byte("aaa"))
+	if v := s.Get(nil, []byte("deleted aaa")); string(v) != "bbb" {
+		t.Fatalf("unexpected value obtained; got %q; want %q", v, "bbb")
+	}
+}
@@ -0,0 +1,107 @@
+package bytestorage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Snapshot writes a point-in-time image of the storage to w.
+//
+// Every bucket is captured atomically, but buckets are captured one
+// after another, so the image isn't consistent across buckets.
+// A bucket lock is held only while references to its entries are copied,
+// so Set and Del aren't blocked while the data is encoded and written.
+//
+// The written data may be loaded with LoadSnapshot.
+func (s *Storage) Snapshot(w io.Writer) error {
+	if _, err := w.Write(appendHeader(nil, s.header())); err != nil {
+		return fmt.Errorf("cannot write header: %w", err)
+	}
+	var buf []byte
+	var entries []entry
+	for i := range s.buckets {
+		buf, entries = s.buckets[i].marshal(buf[:0], entries)
+		if _, err := w.Write(buf); err != nil {
+			return fmt.Errorf("cannot write bucket[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// LoadSnapshot loads storage data written by Storage.Snapshot from r.
+func LoadSnapshot(r io.Reader) (*Storage, error) {
+	return LoadSnapshotWithOptions(r, Options{})
+}
+
+// LoadSnapshotWithOptions loads storage data written by Storage.Snapshot
+// from r into storage created with NewWithOptions(opts).
+//
+// See LoadFromFileWithOptions for details.
+func LoadSnapshotWithOptions(r io.Reader, opts Options) (*Storage, error) {
+	br := bufio.NewReader(r)
+	hdr, err := readHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read header: %w", err)
+	}
+	opts, err = hdr.options(opts)
+	if err != nil {
+		return nil, err
+	}
+	s := NewWithOptions(opts)
+	rehash := mustRehash(hdr.hasher, idOf(s.hasher))
+	for i := uint64(0); i < hdr.bucketsCount; i++ {
+		entries, err := readBucket(br, maxSnapshotLen)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read bucket[%d]: %w", i, unexpectedEOF(err))
+		}
+		s.restore(entries, rehash)
+	}
+	for i := range s.buckets {
+		s.buckets[i].setCalls.Store(0)
+	}
+	return s, nil
+}
+
+// The length of snapshot stream is unknown in advance,
+// so limit key/value length by a sane value.
+const maxSnapshotLen = 1 << 48
+
+// snapshot appends references to all the bucket entries to dst
+// and returns the result. Expired entries are skipped.
+//
+// Referenced memory stays unchanged until releaseSnapshot is called,
+// since bucket.store doesn't reuse memory while snapshots exist.
+func (b *bucket) snapshot(dst []entry) []entry {
+	now := time.Now().UnixNano()
+	b.rlock()
+	for _, idx := range b.m {
+		dst = b.appendEntry(dst, idx, now)
+	}
+	for _, idxs := range b.col {
+		for _, idx := range idxs {
+			dst = b.appendEntry(dst, idx, now)
+		}
+	}
+	b.snapshots.Add(1)
+	b.mu.RUnlock()
+	return dst
+}
+
+func (b *bucket) appendEntry(dst []entry, idx uint64, now int64) []entry {
+	sl := b.slots[idx]
+	if sl.expire != 0 && sl.expire <= now {
+		return dst
+	}
+	// Limit the capacity, so append to the references can't overwrite
+	// the spare capacity used by Storage.Append.
+	k, v := b.kv[idx][0], b.kv[idx][1]
+	return append(dst, entry{h: sl.h, expire: sl.expire, k: k[:len(k):len(k)], v: v[:len(v):len(v)]})
+}
+
+// releaseSnapshot must be called when references obtained
+// via snapshot are no longer used.
+func (b *bucket) releaseSnapshot() {
+	b.snapshots.Add(^uint64(0))
+}
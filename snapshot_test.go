@@ -0,0 +1,139 @@
+package bytestorage
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotLoad(t *testing.T) {
+	const itemsCount = 10000
+	s := New()
+	defer s.Reset()
+	for i := 0; i < itemsCount; i++ {
+		s.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	s.colSet([]byte("aaa"), []byte("bbb"), brokenHash)
+	s.colSet([]byte("bbb"), []byte("ccc"), brokenHash)
+
+	var bb bytes.Buffer
+	if err := s.Snapshot(&bb); err != nil {
+		t.Fatalf("Snapshot error: %s", err)
+	}
+	data := bb.Bytes()
+
+	s1, err := LoadSnapshot(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("LoadSnapshot error: %s", err)
+	}
+	defer s1.Reset()
+	for i := 0; i < itemsCount; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v := fmt.Sprintf("value %d", i)
+		if vv := s1.Get(nil, k); string(vv) != v {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, vv, v)
+		}
+	}
+	if v := s1.colGet(nil, []byte("aaa"), brokenHash); string(v) != "bbb" {
+		t.Fatalf("unexpected value for key %q; got %q; want %q", "aaa", v, "bbb")
+	}
+	if v := s1.colGet(nil, []byte("bbb"), brokenHash); string(v) != "ccc" {
+		t.Fatalf("unexpected value for key %q; got %q; want %q", "bbb", v, "ccc")
+	}
+	if n := s1.EntriesCount(); n != itemsCount+2 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, itemsCount+2)
+	}
+
+	// Truncated and corrupted snapshots must be rejected.
+	if _, err := LoadSnapshot(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Fatalf("expecting non-nil error when loading truncated snapshot")
+	}
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-100] ^= 0xff
+	if _, err := LoadSnapshot(bytes.NewReader(corrupted)); err == nil {
+		t.Fatalf("expecting non-nil error when loading corrupted snapshot")
+	}
+}
+
+func TestSnapshotCopyOnWrite(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	k := []byte("key")
+	s.Set(k, []byte("value 1"))
+
+	b := &s.buckets[s.hasher.Hash(k)&s.mask]
+	entries := b.snapshot(nil)
+	if len(entries) != 1 {
+		t.Fatalf("unexpected number of entries in snapshot; got %d; want %d", len(entries), 1)
+	}
+
+	// Neither replacing nor re-adding the key may touch the captured memory.
+	s.Set(k, []byte("value 2"))
+	if string(entries[0].v) != "value 1" {
+		t.Fatalf("snapshot value changed after Set; got %q; want %q", entries[0].v, "value 1")
+	}
+	s.Del(k)
+	s.Set([]byte("yek"), []byte("value 3"))
+	s.Set(k, []byte("value 4"))
+	if string(entries[0].k) != "key" || string(entries[0].v) != "value 1" {
+		t.Fatalf("snapshot entry changed; got (%q, %q); want (%q, %q)", entries[0].k, entries[0].v, "key", "value 1")
+	}
+	b.releaseSnapshot()
+
+	if v := s.Get(nil, k); string(v) != "value 4" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "value 4")
+	}
+}
+
+func TestSnapshotConcurrent(t *testing.T) {
+	const itemsCount = 1000
+	s := New()
+	defer s.Reset()
+	for i := 0; i < itemsCount; i++ {
+		s.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				for j := 0; j < itemsCount; j++ {
+					k := []byte(fmt.Sprintf("key %d", j))
+					s.Set(k, []byte(fmt.Sprintf("value %d", j)))
+					if j%3 == 0 {
+						s.Del(k)
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		var bb bytes.Buffer
+		if err := s.Snapshot(&bb); err != nil {
+			t.Fatalf("Snapshot error: %s", err)
+		}
+		s1, err := LoadSnapshot(&bb)
+		if err != nil {
+			t.Fatalf("LoadSnapshot error: %s", err)
+		}
+		for j := 0; j < itemsCount; j++ {
+			k := []byte(fmt.Sprintf("key %d", j))
+			v, ok := s1.HasGet(nil, k)
+			if ok && string(v) != fmt.Sprintf("value %d", j) {
+				t.Fatalf("unexpected value for key %q in snapshot; got %q", k, v)
+			}
+		}
+	}
+	close(stopCh)
+	wg.Wait()
+}
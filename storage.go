@@ -2,23 +2,27 @@ package bytestorage
 
 import (
 	"bytes"
-	"github.com/zeebo/xxh3"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
-	// Number of buckets in storage (same as fastcache).
+	// Default number of buckets in storage (same as fastcache).
 	bucketsCount = 512
 
-	// Byte length of key/value to pre-allocate in bucket.
+	// Default byte length of key/value to pre-allocate in bucket.
 	entriesSize = 8
 
-	// Number of elements in each bucket to pre-allocate.
+	// Default number of elements in each bucket to pre-allocate.
 	entriesCount = 16
 
 	// Number of deleted elements to pre-allocate in bucket.
 	freeSize = 2
+
+	// Collision chains longer than this are reported in Stats,
+	// since they are unlikely without crafted keys.
+	longChainLen = 8
 )
 
 // ---- High level ----
@@ -33,6 +37,12 @@ type Stats struct {
 	// SetCalls is the number of Set calls.
 	SetCalls uint64
 
+	// DelCalls is the number of Del calls.
+	DelCalls uint64
+
+	// Hits is the number of storage hits.
+	Hits uint64
+
 	// Misses is the number of storage misses.
 	Misses uint64
 
@@ -44,40 +54,118 @@ type Stats struct {
 
 	// BytesSize is the current size of the storage in bytes.
 	BytesSize uint64
+
+	// AllocatedBytes is the current capacity of keys and values
+	// in the storage, including memory kept for free slots.
+	AllocatedBytes uint64
+
+	// FreeSlots is the current number of allocated slots without entries,
+	// which are reused by the next writes.
+	FreeSlots uint64
+
+	// Evictions is the number of entries evicted from the bounded storage.
+	Evictions uint64
+
+	// CollisionChains is the current number of hashes shared
+	// by more than one key.
+	CollisionChains uint64
+
+	// LongCollisionChains is the current number of hashes shared
+	// by more than 8 keys. Non-zero value usually means that keys
+	// are crafted to collide, see Options.Hasher.
+	LongCollisionChains uint64
+
+	// MaxCollisionChain is the current maximum number of keys
+	// sharing the same hash.
+	MaxCollisionChain uint64
+
+	// BucketStats contains stats of every bucket if the storage
+	// is created with Options.BucketStats.
+	BucketStats []BucketStats
+}
+
+// BucketStats represents stats of a single storage bucket.
+//
+// Compare stats of buckets for finding skewed keys distribution
+// or hot buckets.
+type BucketStats struct {
+	// GetCalls is the number of Get calls for the bucket keys.
+	GetCalls uint64
+
+	// SetCalls is the number of Set calls for the bucket keys.
+	SetCalls uint64
+
+	// EntriesCount is the current number of entries in the bucket.
+	EntriesCount uint64
+
+	// BytesSize is the current size of the bucket in bytes.
+	BytesSize uint64
+
+	// LockWait is the total time spent waiting for the bucket lock.
+	LockWait time.Duration
 }
 
 // Reset resets s, so it may be re-used again in Storage.UpdateStats.
 func (s *Stats) Reset() {
-	*s = Stats{}
+	*s = Stats{BucketStats: s.BucketStats[:0]}
 }
 
 // Storage just contains an array of buckets
 type Storage struct {
-	buckets [bucketsCount]bucket
+	buckets []bucket
+
+	// mask selects the bucket for a key hash, len(buckets)-1.
+	mask uint64
+
+	hasher Hasher
+
+	// Write-ahead log attached by AttachWAL.
+	wal atomic.Pointer[WAL]
 }
 
-// New returns new Storage.
+// New returns new Storage with default options.
+//
+// See NewWithOptions for tuning the storage.
 func New() *Storage {
-	var s Storage
-	for i := range s.buckets[:] {
-		s.buckets[i].init()
-	}
-	return &s
+	return NewWithOptions(Options{})
 }
 
 // Reset removes all the items from the storage.
 func (s *Storage) Reset() {
-	for i := range s.buckets[:] {
-		s.buckets[i].reset()
-		s.buckets[i].init()
+	// All the buckets are locked while the reset is logged, so a write
+	// racing with Reset is either logged before the reset and removed,
+	// or logged after it and kept.
+	for i := range s.buckets {
+		s.buckets[i].lock()
+	}
+	if w := s.wal.Load(); w != nil {
+		w.append(walReset, 0, 0, nil, nil)
+	}
+	var removed []removal
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		b.resetLocked()
+		b.initLocked()
+		removed = append(removed, b.removed...)
+		b.removed = nil
+	}
+	fn := s.buckets[0].onRemove
+	for i := range s.buckets {
+		s.buckets[i].mu.Unlock()
+	}
+	// onRemove is called after all the locks are released,
+	// so it may access any bucket.
+	for _, r := range removed {
+		fn(r.k, r.v, r.reason)
 	}
 }
 
 // UpdateStats adds storage stats to s.
 //
 // Call s.Reset before calling UpdateStats if s is re-used.
+// Stats of buckets are appended to s.BucketStats.
 func (s *Storage) UpdateStats(stats *Stats) {
-	for i := range s.buckets[:] {
+	for i := range s.buckets {
 		s.buckets[i].updateStats(stats)
 	}
 }
@@ -85,15 +173,15 @@ func (s *Storage) UpdateStats(stats *Stats) {
 // Set stores (k, v) in the storage.
 // nil key is acceptable.
 func (s *Storage) Set(k, v []byte) {
-	h := xxh3.Hash(k)
-	idx := h % bucketsCount
+	h := s.hasher.Hash(k)
+	idx := h & s.mask
 	s.buckets[idx].set(k, v, h)
 }
 
 // Get returns value for the given key k.
 func (s *Storage) Get(dst, k []byte) []byte {
-	h := xxh3.Hash(k)
-	idx := h % bucketsCount
+	h := s.hasher.Hash(k)
+	idx := h & s.mask
 	dst, _ = s.buckets[idx].get(dst, k, h)
 	return dst
 }
@@ -101,22 +189,70 @@ func (s *Storage) Get(dst, k []byte) []byte {
 // HasGet works identically to Get, but also returns whether the given key
 // exists in the storage.
 func (s *Storage) HasGet(dst, k []byte) ([]byte, bool) {
-	h := xxh3.Hash(k)
-	idx := h % bucketsCount
+	h := s.hasher.Hash(k)
+	idx := h & s.mask
 	return s.buckets[idx].get(dst, k, h)
 }
 
 // Has returns true if entry for the given key k exists in the storage.
 func (s *Storage) Has(k []byte) bool {
-	h := xxh3.Hash(k)
-	idx := h % bucketsCount
+	h := s.hasher.Hash(k)
+	idx := h & s.mask
 	return s.buckets[idx].has(k, h)
 }
 
 // Del deletes value for the given k from the storage.
 func (s *Storage) Del(k []byte) {
-	h := xxh3.Hash(k)
-	idx := h % bucketsCount
+	h := s.hasher.Hash(k)
+	idx := h & s.mask
+	s.buckets[idx].del(k, h)
+}
+
+// SetHash works identically to Set, but uses the given hash h of k
+// instead of computing it.
+//
+// The same h must be passed for k to all the *Hash calls. Keys with
+// equal hashes are still compared, so a wrong h never returns the value
+// of another key. Use Options.Hasher for computing hashes the same way
+// if k is also accessed via Set, Get, Has or Del.
+//
+// Data saved with a built-in Hasher is hashed again by the Hasher
+// when loaded into storage with another Hasher, so h is lost.
+func (s *Storage) SetHash(k, v []byte, h uint64) {
+	idx := h & s.mask
+	s.buckets[idx].set(k, v, h)
+}
+
+// GetHash works identically to Get, but uses the given hash h of k.
+//
+// See SetHash for details.
+func (s *Storage) GetHash(dst, k []byte, h uint64) []byte {
+	idx := h & s.mask
+	dst, _ = s.buckets[idx].get(dst, k, h)
+	return dst
+}
+
+// HasGetHash works identically to HasGet, but uses the given hash h of k.
+//
+// See SetHash for details.
+func (s *Storage) HasGetHash(dst, k []byte, h uint64) ([]byte, bool) {
+	idx := h & s.mask
+	return s.buckets[idx].get(dst, k, h)
+}
+
+// HasHash works identically to Has, but uses the given hash h of k.
+//
+// See SetHash for details.
+func (s *Storage) HasHash(k []byte, h uint64) bool {
+	idx := h & s.mask
+	return s.buckets[idx].has(k, h)
+}
+
+// DelHash works identically to Del, but uses the given hash h of k.
+//
+// See SetHash for details.
+func (s *Storage) DelHash(k []byte, h uint64) {
+	idx := h & s.mask
 	s.buckets[idx].del(k, h)
 }
 
@@ -125,8 +261,8 @@ func (s *Storage) Del(k []byte) {
 // Prefer using Storage.UpdateStats
 func (s *Storage) Size() uint64 {
 	var size uint64
-	for i := range s.buckets[:] {
-		size += atomic.LoadUint64(&s.buckets[i].size)
+	for i := range s.buckets {
+		size += s.buckets[i].size.Load()
 	}
 	return size
 }
@@ -136,8 +272,8 @@ func (s *Storage) Size() uint64 {
 // Prefer using Storage.UpdateStats
 func (s *Storage) Collision() uint64 {
 	var col uint64
-	for i := range s.buckets[:] {
-		col += atomic.LoadUint64(&s.buckets[i].collisions)
+	for i := range s.buckets {
+		col += s.buckets[i].collisions.Load()
 	}
 	return col
 }
@@ -147,7 +283,7 @@ func (s *Storage) Collision() uint64 {
 // Prefer using Storage.UpdateStats
 func (s *Storage) EntriesCount() uint64 {
 	var c uint64
-	for i := range s.buckets[:] {
+	for i := range s.buckets {
 		c += s.buckets[i].getEntriesCount()
 	}
 	return c
@@ -218,7 +354,13 @@ type bucket struct {
 	mu sync.RWMutex
 
 	// Bucket size
-	size uint64
+	size atomic.Uint64
+
+	// Capacity of keys and values in kv.
+	allocated atomic.Uint64
+
+	// Initial sizes of the bucket, shared with other buckets.
+	opts *bucketOptions
 
 	// m maps hash(k) to idx of (k, v) pair in kv.
 	m map[uint64]uint64
@@ -229,94 +371,244 @@ type bucket struct {
 	// Main key-value byte slice. Both m and col shares it.
 	kv [][2][]byte
 
+	// Metadata of kv entries with the same index.
+	slots []slot
+
 	// Contains deleted entries in kv
 	free []uint64
 
+	// Write-ahead log for set and del, nil if not attached.
+	wal *WAL
+
+	// Callback for removed entries, nil if not set.
+	onRemove func(k, v []byte, reason RemovalReason)
+
+	// Entries removed under the lock, which are passed to onRemove
+	// after unlock.
+	removed []removal
+
+	// Number of entries with expiration deadline.
+	ttls uint64
+
+	// Position in kv where the next sweep starts.
+	sweepPos uint64
+
 	// Bucket offset shows the position of last entry in the kv.
 	offset uint64
 
-	getCalls   uint64
-	setCalls   uint64
-	misses     uint64
-	collisions uint64
+	// Number of entries in the bucket.
+	entries uint64
+
+	// Number of col chains longer than longChainLen.
+	longChains atomic.Uint64
+
+	// Eviction state, used only by the bounded storage.
+	ev evictor
+
+	// Number of snapshots holding views into kv. While it isn't zero
+	// memory of kv entries must not be overwritten in place.
+	snapshots atomic.Uint64
+
+	// Time in nanoseconds spent waiting for mu,
+	// counted only with Options.BucketStats.
+	lockWait atomic.Uint64
+
+	getCalls   atomic.Uint64
+	setCalls   atomic.Uint64
+	delCalls   atomic.Uint64
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+	collisions atomic.Uint64
+}
+
+// slot contains metadata of the kv entry.
+type slot struct {
+	// Hash of the key.
+	h uint64
+
+	// Expiration deadline in unix nanoseconds, 0 if the entry never expires.
+	expire int64
 }
 
 func (b *bucket) init() {
-	b.mu.Lock()
-	b.m = make(map[uint64]uint64, entriesCount)
-	b.kv = make([][2][]byte, entriesCount)
+	b.lock()
+	b.initLocked()
+	b.mu.Unlock()
+}
+
+// initLocked is init for the caller holding the bucket write lock.
+func (b *bucket) initLocked() {
+	if b.opts.lazy {
+		// Drop the memory, it is allocated again on the first write.
+		b.m = nil
+		b.col = nil
+		b.kv = nil
+		b.slots = nil
+		b.free = nil
+		b.allocated.Store(0)
+	} else {
+		b.alloc()
+	}
+}
+
+// alloc allocates bucket memory.
+//
+// Must be called under the bucket write lock.
+func (b *bucket) alloc() {
+	o := b.opts
+	b.m = make(map[uint64]uint64, o.mapSize)
+	b.kv = make([][2][]byte, o.entriesCount)
+	b.slots = make([]slot, o.entriesCount)
 	b.col = make(map[uint64][]uint64) // no need to pre-allocate, considering collision unlikely to happen
 	b.free = make([]uint64, 0, freeSize)
-	for i := 0; i < entriesCount; i++ {
-		b.kv[i][0] = make([]byte, 0, entriesSize)
-		b.kv[i][1] = make([]byte, 0, entriesSize)
+	for i := 0; i < o.entriesCount; i++ {
+		b.kv[i][0] = make([]byte, 0, o.entriesSize)
+		b.kv[i][1] = make([]byte, 0, o.entriesSize)
 	}
-	b.mu.Unlock()
+	b.allocated.Store(uint64(2 * o.entriesCount * o.entriesSize))
+	b.ev.init(o.entriesCount)
 }
 
-func (b *bucket) reset() {
-	b.mu.Lock()
-	atomic.StoreUint64(&b.size, 0)
+// resetLocked removes all the entries and zeroes the bucket stats.
+//
+// Must be called under the bucket write lock. Removed entries are
+// queued for onRemove.
+func (b *bucket) resetLocked() {
+	if b.onRemove != nil {
+		for _, idx := range b.m {
+			b.detach(idx, ReasonReset)
+		}
+		for _, idxs := range b.col {
+			for _, idx := range idxs {
+				b.detach(idx, ReasonReset)
+			}
+		}
+	}
+	b.size.Store(0)
 	clear(b.m)
 	clear(b.col)
 	clear(b.kv)
+	b.allocated.Store(0)
 	clear(b.free)
 	b.offset = 0
-	atomic.StoreUint64(&b.getCalls, 0)
-	atomic.StoreUint64(&b.setCalls, 0)
-	atomic.StoreUint64(&b.misses, 0)
-	atomic.StoreUint64(&b.collisions, 0)
-	b.mu.Unlock()
+	b.entries = 0
+	b.longChains.Store(0)
+	b.ttls = 0
+	b.sweepPos = 0
+	b.getCalls.Store(0)
+	b.setCalls.Store(0)
+	b.delCalls.Store(0)
+	b.hits.Store(0)
+	b.misses.Store(0)
+	b.collisions.Store(0)
+	b.ev.evictions.Store(0)
+	b.lockWait.Store(0)
 }
 
 func (b *bucket) updateStats(s *Stats) {
-	s.GetCalls += atomic.LoadUint64(&b.getCalls)
-	s.SetCalls += atomic.LoadUint64(&b.setCalls)
-	s.Misses += atomic.LoadUint64(&b.misses)
-	s.Collisions += atomic.LoadUint64(&b.collisions)
-	s.BytesSize += atomic.LoadUint64(&b.size)
-
-	b.mu.RLock()
-	s.EntriesCount += uint64(len(b.kv))
+	s.GetCalls += b.getCalls.Load()
+	s.SetCalls += b.setCalls.Load()
+	s.DelCalls += b.delCalls.Load()
+	s.Hits += b.hits.Load()
+	s.Misses += b.misses.Load()
+	s.Collisions += b.collisions.Load()
+	s.BytesSize += b.size.Load()
+	s.AllocatedBytes += b.allocated.Load()
+	s.Evictions += b.ev.evictions.Load()
+	s.LongCollisionChains += b.longChains.Load()
+
+	b.rlock()
+	s.EntriesCount += b.entries
+	s.FreeSlots += uint64(len(b.kv)) - b.entries
+	s.CollisionChains += uint64(len(b.col))
 	for _, v := range b.col {
-		s.EntriesCount += uint64(len(v))
+		if n := uint64(len(v)); n > s.MaxCollisionChain {
+			s.MaxCollisionChain = n
+		}
+	}
+	if b.opts.bucketStats {
+		s.BucketStats = append(s.BucketStats, BucketStats{
+			GetCalls:     b.getCalls.Load(),
+			SetCalls:     b.setCalls.Load(),
+			EntriesCount: b.entries,
+			BytesSize:    b.size.Load(),
+			LockWait:     time.Duration(b.lockWait.Load()),
+		})
 	}
+	b.mu.RUnlock()
+}
 
+func (b *bucket) getEntriesCount() uint64 {
+	b.rlock()
+	n := b.entries
 	b.mu.RUnlock()
+	return n
 }
 
-func (b *bucket) getEntriesCount() (size uint64) {
-	b.mu.RLock()
-	size += uint64(len(b.m))
-	for _, v := range b.col {
-		size += uint64(len(v))
+// lock acquires the bucket write lock.
+func (b *bucket) lock() {
+	if !b.opts.bucketStats {
+		b.mu.Lock()
+		return
 	}
-	b.mu.RUnlock()
-	return
+	// Uncontended locks are cheap, so don't ask the clock for them.
+	if b.mu.TryLock() {
+		return
+	}
+	start := time.Now()
+	b.mu.Lock()
+	b.lockWait.Add(uint64(time.Since(start)))
+}
+
+// rlock acquires the bucket read lock.
+func (b *bucket) rlock() {
+	if !b.opts.bucketStats {
+		b.mu.RLock()
+		return
+	}
+	if b.mu.TryRLock() {
+		return
+	}
+	start := time.Now()
+	b.mu.RLock()
+	b.lockWait.Add(uint64(time.Since(start)))
 }
 
 func (b *bucket) get(dst, k []byte, h uint64) ([]byte, bool) {
-	atomic.AddUint64(&b.getCalls, 1)
+	b.rlock()
+	dst, found := b.getLocked(dst, k, h)
+	b.mu.RUnlock()
+	return dst, found
+}
+
+// getLocked is get for the caller holding the bucket lock.
+func (b *bucket) getLocked(dst, k []byte, h uint64) ([]byte, bool) {
+	b.getCalls.Add(1)
 	var found bool
 	var idx uint64
 	var idxs []uint64
 	// Collision protection
-	b.mu.RLock()
-	if atomic.LoadUint64(&b.collisions) != 0 {
+	b.ev.record(h)
+	if b.collisions.Load() != 0 {
 		// Check if hash is in collision map
 		idxs, found = b.col[h]
 		// Hash is in col
 		if found {
-			atomic.AddUint64(&b.collisions, 1)
+			b.collisions.Add(1)
 			for _, idx = range idxs {
 				// Key exist in kv
 				if string(b.kv[idx][0]) == string(k) {
+					if b.expired(idx) {
+						break
+					}
+					b.ev.touch(idx)
 					dst = append(dst, b.kv[idx][1]...)
 					goto end
 				}
 			}
 			// Hash exist in col but could not find the given k
-			atomic.AddUint64(&b.misses, 1)
+			b.misses.Add(1)
+			found = false
 			goto end
 		}
 		// No collision for this hash, continue to search in m
@@ -326,35 +618,47 @@ mcheck:
 	idx, found = b.m[h]
 	if found {
 		if string(b.kv[idx][0]) == string(k) {
-			dst = append(dst, b.kv[idx][1]...)
-			goto end
+			if !b.expired(idx) {
+				b.ev.touch(idx)
+				dst = append(dst, b.kv[idx][1]...)
+				goto end
+			}
+		} else {
+			b.collisions.Add(1)
 		}
-		atomic.AddUint64(&b.collisions, 1)
+		found = false
 	}
-	atomic.AddUint64(&b.misses, 1)
+	b.misses.Add(1)
 end:
-	b.mu.RUnlock()
+	if found {
+		b.hits.Add(1)
+	}
 	return dst, found
 }
 
 // Need for compatibility  with fastcache
 func (b *bucket) has(k []byte, h uint64) bool {
-	atomic.AddUint64(&b.getCalls, 1)
+	b.getCalls.Add(1)
 	var found bool
 	var idx uint64
 	var idxs []uint64
-	b.mu.RLock()
-	if atomic.LoadUint64(&b.collisions) != 0 {
+	b.rlock()
+	b.ev.record(h)
+	if b.collisions.Load() != 0 {
 		idxs, found = b.col[h]
 		if found {
-			atomic.AddUint64(&b.collisions, 1)
+			b.collisions.Add(1)
 			for _, idx = range idxs {
 				if string(b.kv[idx][0]) == string(k) {
+					if b.expired(idx) {
+						break
+					}
+					b.ev.touch(idx)
 					goto end
 				}
 			}
 			// Hash exist in col but could not find the given k
-			atomic.AddUint64(&b.misses, 1)
+			b.misses.Add(1)
 			found = false
 			goto end
 		}
@@ -365,35 +669,93 @@ mcheck:
 	idx, found = b.m[h]
 	if found {
 		if string(b.kv[idx][0]) == string(k) {
-			goto end
+			if !b.expired(idx) {
+				b.ev.touch(idx)
+				goto end
+			}
+		} else {
+			b.collisions.Add(1)
 		}
 		found = false
-		atomic.AddUint64(&b.collisions, 1)
 	}
-	atomic.AddUint64(&b.misses, 1)
+	b.misses.Add(1)
 end:
 	b.mu.RUnlock()
+	if found {
+		b.hits.Add(1)
+	}
 	return found
 }
 
+// find returns the index of k in kv.
+//
+// Must be called under the bucket lock.
+func (b *bucket) find(k []byte, h uint64) (uint64, bool) {
+	if b.collisions.Load() != 0 {
+		if idxs, found := b.col[h]; found {
+			b.collisions.Add(1)
+			for _, idx := range idxs {
+				if string(b.kv[idx][0]) == string(k) {
+					return idx, true
+				}
+			}
+			return 0, false
+		}
+	}
+	idx, found := b.m[h]
+	if !found {
+		return 0, false
+	}
+	if string(b.kv[idx][0]) != string(k) {
+		b.collisions.Add(1)
+		return 0, false
+	}
+	return idx, true
+}
+
 func (b *bucket) set(k, v []byte, h uint64) {
-	atomic.AddUint64(&b.setCalls, 1)
+	b.put(k, v, h, 0)
+}
+
+// put stores (k, v) with the given expiration deadline in unix nanoseconds.
+// Zero expire means the entry never expires.
+func (b *bucket) put(k, v []byte, h uint64, expire int64) {
+	b.lock()
+	b.putLocked(k, v, h, expire)
+	b.unlock()
+}
+
+// putLocked is put for the caller holding the bucket write lock.
+//
+// The caller must release the lock with b.unlock.
+func (b *bucket) putLocked(k, v []byte, h uint64, expire int64) {
+	b.setCalls.Add(1)
 	var found bool
 	var idx uint64
 	var idxs []uint64
 
+	// Memory of buckets created with Options.LazyInit
+	// is allocated on the first write.
+	if b.m == nil {
+		b.alloc()
+	}
+	b.ev.record(h)
+
 	// It's slow to check the col every time to see if it contains the hash.
 	// Because collision is unlikely to happen we can just check if b.collisions
 	// is null instead of locking collision map (col) every time we call set/get.
-	b.mu.Lock()
-	if atomic.LoadUint64(&b.collisions) != 0 {
+	if b.collisions.Load() != 0 {
 		// Check if given hash exist in collision map
 		idxs, found = b.col[h]
 		if found {
-			b.collisions++
+			b.collisions.Add(1)
 			// Iterating through keys
 			for _, idx = range idxs {
 				if string(b.kv[idx][0]) == string(k) {
+					b.replace(idx, v)
+					b.setExpire(idx, expire)
+					b.ev.touch(idx)
+
 					// Value is the same. Nothing to do...
 					if string(b.kv[idx][1]) == string(v) {
 						goto end
@@ -401,21 +763,18 @@ func (b *bucket) set(k, v []byte, h uint64) {
 
 					// Split into 2 separate uint64 to avoid uint64 overflow in case
 					// length of new value in smaller than length of value in kv
-					atomic.AddUint64(&b.size, uint64(len(v))-uint64(len(b.kv[idx][1])))
-
-					// Slice has enough capacity to contain v
-					if cap(b.kv[idx][1]) >= len(v) {
-						b.kv[idx][1] = b.kv[idx][1][:len(v)]
-						copy(b.kv[idx][1], v)
-					} else {
-						b.kv[idx][1] = bytes.Clone(v)
-					}
+					b.size.Add(uint64(len(v)) - uint64(len(b.kv[idx][1])))
+
+					b.kv[idx][1] = b.store(b.kv[idx][1], v)
 					goto end
 				}
 			}
 			// New key has same hash, add new key
 			idxs = append(idxs, b.offset)
 			b.col[h] = idxs
+			if len(idxs) == longChainLen+1 {
+				b.longChains.Add(1)
+			}
 			goto add
 		}
 		goto mcheck
@@ -427,8 +786,8 @@ mcheck:
 		// Second collision check
 		if string(b.kv[idx][0]) != string(k) {
 			// Found a new pair of keys that has the same hash
-			atomic.AddUint64(&b.collisions, 1)
-			//b.collisions++
+			b.collisions.Add(1)
+			//b.collisions.Add(1)
 			newIdxs := make([]uint64, 2)
 			// Add old key idx
 			newIdxs[0] = idx
@@ -440,41 +799,30 @@ mcheck:
 			delete(b.m, h)
 			goto add
 		}
+		b.replace(idx, v)
+		b.setExpire(idx, expire)
+		b.ev.touch(idx)
+
 		// Value is the same. Nothing to do...
 		if string(b.kv[idx][1]) == string(v) {
 			goto end
 		}
 
-		atomic.AddUint64(&b.size, uint64(len(v))-uint64(len(b.kv[idx][1])))
-		// Slice has enough capacity to contain v
-		if cap(b.kv[idx][1]) >= len(v) {
-			b.kv[idx][1] = b.kv[idx][1][:len(v)]
-			copy(b.kv[idx][1], v)
-		} else {
-			b.kv[idx][1] = bytes.Clone(v)
-		}
+		b.size.Add(uint64(len(v)) - uint64(len(b.kv[idx][1])))
+		b.kv[idx][1] = b.store(b.kv[idx][1], v)
 		goto end
 	}
 	// Check if free space exist
 	if l := len(b.free); l > 0 {
 		idx = b.free[l-1]
-		atomic.AddUint64(&b.size, uint64(len(v)+len(k)))
+		b.size.Add(uint64(len(v) + len(k)))
 
-		// Slice has enough capacity to contain key
-		if cap(b.kv[idx][0]) >= len(k) {
-			b.kv[idx][0] = b.kv[idx][0][:len(k)]
-			copy(b.kv[idx][0], k)
-		} else {
-			b.kv[idx][0] = bytes.Clone(k)
-		}
-
-		// Slice has enough capacity to contain value
-		if cap(b.kv[idx][1]) >= len(v) {
-			b.kv[idx][1] = b.kv[idx][1][:len(v)]
-			copy(b.kv[idx][1], v)
-		} else {
-			b.kv[idx][1] = bytes.Clone(v)
-		}
+		b.kv[idx][0] = b.store(b.kv[idx][0], k)
+		b.kv[idx][1] = b.store(b.kv[idx][1], v)
+		b.slots[idx].h = h
+		b.setExpire(idx, expire)
+		b.ev.insert(idx)
+		b.entries++
 
 		// Remove last item from free slice
 		b.free = b.free[:l-1]
@@ -486,86 +834,85 @@ mcheck:
 	b.m[h] = b.offset
 
 add:
+	idx = b.offset
 	// kv has free space to store one more element
 	if b.offset < uint64(len(b.kv)) {
-		// Slice has enough capacity to contain key
-		if cap(b.kv[b.offset][0]) >= len(k) {
-			b.kv[b.offset][0] = b.kv[b.offset][0][:len(k)]
-			copy(b.kv[b.offset][0], k)
-		} else {
-			b.kv[b.offset][0] = bytes.Clone(k)
-		}
-
-		// Slice has enough capacity to contain value
-		if cap(b.kv[b.offset][1]) >= len(v) {
-			b.kv[b.offset][1] = b.kv[b.offset][1][:len(v)]
-			copy(b.kv[b.offset][1], v)
-		} else {
-			b.kv[b.offset][1] = bytes.Clone(v)
-		}
-
+		b.kv[b.offset][0] = b.store(b.kv[b.offset][0], k)
+		b.kv[b.offset][1] = b.store(b.kv[b.offset][1], v)
+		b.slots[b.offset].h = h
 	} else {
 		// If not, append to kv
 		newKv := [2][]byte{}
 		newKv[0] = bytes.Clone(k)
 		newKv[1] = bytes.Clone(v)
+		b.allocated.Add(uint64(cap(newKv[0]) + cap(newKv[1])))
 		b.kv = append(b.kv, newKv)
+		b.slots = append(b.slots, slot{h: h})
+		b.ev.grow()
 	}
+	b.setExpire(b.offset, expire)
+	b.ev.insert(b.offset)
 	b.offset++
-	atomic.AddUint64(&b.size, uint64(len(v)+len(k)))
+	b.entries++
+	b.size.Add(uint64(len(v) + len(k)))
 end:
-	b.mu.Unlock()
+	if b.ev.limited() {
+		b.evict(idx)
+	}
+	if b.wal != nil {
+		// Evicted entries are logged as deleted before the write,
+		// so replay into the bounded storage doesn't evict others.
+		b.wal.append(walSet, h, expire, k, v)
+	}
+}
+
+// store copies src into dst and returns the result.
+//
+// dst memory is reused if it has enough capacity and isn't
+// referenced by any snapshot.
+func (b *bucket) store(dst, src []byte) []byte {
+	if cap(dst) >= len(src) && b.snapshots.Load() == 0 {
+		dst = dst[:len(src)]
+		copy(dst, src)
+		return dst
+	}
+	c := bytes.Clone(src)
+	b.allocated.Add(uint64(cap(c)) - uint64(cap(dst)))
+	return c
 }
 
 func (b *bucket) del(k []byte, h uint64) {
+	b.lock()
+	b.delLocked(k, h)
+	b.unlock()
+}
+
+// delLocked is del for the caller holding the bucket write lock.
+//
+// The caller must release the lock with b.unlock.
+func (b *bucket) delLocked(k []byte, h uint64) {
+	b.delCalls.Add(1)
 	var found bool
 	var idx uint64
-	var pos int
 	var idxs []uint64
-	b.mu.Lock()
-	if atomic.LoadUint64(&b.collisions) != 0 {
+	if b.wal != nil {
+		b.wal.append(walDel, h, 0, k, nil)
+	}
+	if b.collisions.Load() != 0 {
 		// Check if hash is in collision map
 		idxs, found = b.col[h]
 		// Hash is in col
 		if found {
-			atomic.AddUint64(&b.collisions, 1)
-			for pos, idx = range idxs {
+			b.collisions.Add(1)
+			for _, idx = range idxs {
 				// Key exist in kv
 				if string(b.kv[idx][0]) == string(k) {
-					atomic.AddUint64(&b.size, -uint64(len(b.kv[idx][0])+len(b.kv[idx][1])))
-
-					// Clear kv[i] but keep allocated memory
-					b.kv[idx][0] = b.kv[idx][0][0:0]
-					b.kv[idx][1] = b.kv[idx][1][0:0]
-
-					// Add deleted element to free slice
-					b.free = append(b.free, uint64(idx))
-
-					// Idxs order is not important so delete without preserving order.
-					idxs[pos] = idxs[len(idxs)-1]
-					idxs = idxs[:len(idxs)-1]
-
-					// Then are more than 2 keys in storage that have same hash
-					// after removing one, it means that there are still key that causes hash collisions.
-					// So just remove one key from idxs and update the collision map
-					if len(idxs) >= 2 {
-						b.col[h] = idxs
-						goto end
-					}
-					// There are 2 keys that causes hash collision. So after removing one of them
-					// collision will not exist anymore. Remove this hash from collision map and
-					// add it to m
-					if len(idxs) != 1 {
-						panic("BUG: idxs size is not 1.")
-					}
-
-					b.m[h] = idxs[0]
-					delete(b.col, h)
+					b.remove(idx, b.removalReason(idx, ReasonDeleted))
 					goto end
 				}
 			}
 			// Hash exist in col but could not find the given k
-			atomic.AddUint64(&b.misses, 1)
+			b.misses.Add(1)
 			goto end
 		}
 		goto mcheck
@@ -576,14 +923,65 @@ mcheck:
 		goto end
 	}
 	if string(b.kv[idx][0]) == string(k) {
-		atomic.AddUint64(&b.size, -uint64(len(b.kv[idx][0])+len(b.kv[idx][1])))
+		b.remove(idx, b.removalReason(idx, ReasonDeleted))
+		goto end
+	}
+	b.collisions.Add(1)
+end:
+}
+
+// remove deletes kv[idx] from the bucket, but keeps its memory
+// for further inserts unless it is passed to onRemove.
+//
+// Must be called under the bucket write lock.
+func (b *bucket) remove(idx uint64, reason RemovalReason) {
+	h := b.slots[idx].h
+	b.size.Add(-uint64(len(b.kv[idx][0]) + len(b.kv[idx][1])))
+
+	if b.onRemove != nil {
+		b.detach(idx, reason)
+	} else {
+		// Clear kv[i] but keep allocated memory
 		b.kv[idx][0] = b.kv[idx][0][0:0]
 		b.kv[idx][1] = b.kv[idx][1][0:0]
-		b.free = append(b.free, idx)
+	}
+	b.setExpire(idx, 0)
+	b.ev.delete(idx)
+	b.entries--
+
+	// Add deleted element to free slice
+	b.free = append(b.free, idx)
+
+	idxs, found := b.col[h]
+	if !found {
 		delete(b.m, h)
-		goto end
+		return
 	}
-	atomic.AddUint64(&b.collisions, 1)
-end:
-	b.mu.Unlock()
+	for pos := range idxs {
+		if idxs[pos] == idx {
+			// Idxs order is not important so delete without preserving order.
+			idxs[pos] = idxs[len(idxs)-1]
+			idxs = idxs[:len(idxs)-1]
+			break
+		}
+	}
+
+	// Then are more than 2 keys in storage that have same hash
+	// after removing one, it means that there are still key that causes hash collisions.
+	// So just remove one key from idxs and update the collision map
+	if len(idxs) >= 2 {
+		b.col[h] = idxs
+		if len(idxs) == longChainLen {
+			b.longChains.Add(^uint64(0))
+		}
+		return
+	}
+	// There are 2 keys that causes hash collision. So after removing one of them
+	// collision will not exist anymore. Remove this hash from collision map and
+	// add it to m
+	if len(idxs) != 1 {
+		panic("BUG: idxs size is not 1.")
+	}
+	b.m[h] = idxs[0]
+	delete(b.col, h)
 }
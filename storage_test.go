@@ -20,25 +20,25 @@ const (
 // Generates same hash for every key
 
 func (s *Storage) colSet(k, v []byte, h uint64) {
-	idx := h % bucketsCount
+	idx := h & s.mask
 	s.buckets[idx].set(k, v, h)
 }
 func (s *Storage) colGet(dst, k []byte, h uint64) []byte {
-	idx := h % bucketsCount
+	idx := h & s.mask
 	dst, _ = s.buckets[idx].get(dst, k, h)
 	return dst
 }
 func (s *Storage) colDel(k []byte, h uint64) {
-	idx := h % bucketsCount
+	idx := h & s.mask
 	s.buckets[idx].del(k, h)
 }
 func (s *Storage) colHas(k []byte, h uint64) bool {
-	idx := h % bucketsCount
+	idx := h & s.mask
 	return s.buckets[idx].has(k, h)
 }
 
 // func (s *Storage) debug() {
-// 	for i := range s.buckets[:] {
+// 	for i := range s.buckets {
 // 		s.buckets[i].debug()
 // 	}
 // }
@@ -600,6 +600,9 @@ func TestStorageStats(t *testing.T) {
 	if s.Misses != 0 {
 		t.Fatalf("unexpected number of misses; got %d; it should be 0", s.Misses)
 	}
+	if s.Hits != getCalls {
+		t.Fatalf("unexpected number of hits; got %d; want %d", s.Hits, getCalls)
+	}
 	if s.Collisions != 0 {
 		t.Fatalf("unexpected number of collisions; got %d; want 0", s.Collisions)
 	}
@@ -615,6 +618,170 @@ func TestStorageStats(t *testing.T) {
 	// }
 }
 
+func TestStorageStatsAllocated(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		c := NewWithOptions(Options{BucketsCount: 4, EntriesCount: 16, EntrySize: 8, LazyInit: lazy})
+		var removed int
+		c.OnRemove(func(k, v []byte, reason RemovalReason) {
+			removed++
+		})
+		for i := 0; i < 100; i++ {
+			k := []byte(fmt.Sprintf("key %d", i))
+			c.Set(k, k)
+			c.Set(k, []byte(fmt.Sprintf("a value longer than the entry size %d", i)))
+			c.Append(k, k)
+		}
+		for i := 0; i < 100; i += 2 {
+			c.Del([]byte(fmt.Sprintf("key %d", i)))
+		}
+		// checkBuckets compares the allocated bytes with capacities in kv.
+		checkBuckets(t, c)
+
+		c.Reset()
+		checkBuckets(t, c)
+		want := uint64(4 * 16 * 2 * 8)
+		if lazy {
+			want = 0
+		}
+		var s Stats
+		c.UpdateStats(&s)
+		if s.AllocatedBytes != want {
+			t.Fatalf("unexpected AllocatedBytes after reset; got %d; want %d", s.AllocatedBytes, want)
+		}
+		if removed == 0 {
+			t.Fatalf("OnRemove must be called")
+		}
+	}
+}
+
+func TestStorageStatsEntries(t *testing.T) {
+	c := NewWithOptions(Options{BucketsCount: 1, EntriesCount: 16, EntrySize: 8})
+	defer c.Reset()
+
+	var s Stats
+	c.UpdateStats(&s)
+	if s.EntriesCount != 0 {
+		t.Fatalf("unexpected EntriesCount of empty storage; got %d; want 0", s.EntriesCount)
+	}
+	if s.FreeSlots != 16 {
+		t.Fatalf("unexpected FreeSlots of empty storage; got %d; want 16", s.FreeSlots)
+	}
+	if s.AllocatedBytes != 16*2*8 {
+		t.Fatalf("unexpected AllocatedBytes of empty storage; got %d; want %d", s.AllocatedBytes, 16*2*8)
+	}
+
+	c.colSet([]byte("key1"), []byte("value1"), brokenHash)
+	c.colSet([]byte("key2"), []byte("value2"), brokenHash)
+	c.colSet([]byte("key3"), []byte("value3"), brokenHash)
+	c.Set([]byte("key4"), []byte("a value longer than the entry size"))
+	c.colDel([]byte("key1"), brokenHash)
+	c.Del([]byte("missing"))
+	if v := c.Get(nil, []byte("key4")); len(v) == 0 {
+		t.Fatalf("missing key %q", "key4")
+	}
+	if c.Has([]byte("missing")) {
+		t.Fatalf("unexpected key %q", "missing")
+	}
+
+	s.Reset()
+	c.UpdateStats(&s)
+	if s.EntriesCount != 3 {
+		t.Fatalf("unexpected EntriesCount; got %d; want 3", s.EntriesCount)
+	}
+	if n := c.EntriesCount(); n != s.EntriesCount {
+		t.Fatalf("EntriesCount disagrees with Stats; got %d; want %d", n, s.EntriesCount)
+	}
+	if s.FreeSlots != 13 {
+		t.Fatalf("unexpected FreeSlots; got %d; want 13", s.FreeSlots)
+	}
+	if s.AllocatedBytes < 16*2*8+uint64(len("a value longer than the entry size")) {
+		t.Fatalf("AllocatedBytes doesn't include the grown value; got %d", s.AllocatedBytes)
+	}
+	if s.DelCalls != 2 {
+		t.Fatalf("unexpected DelCalls; got %d; want 2", s.DelCalls)
+	}
+	if s.Hits != 1 {
+		t.Fatalf("unexpected Hits; got %d; want 1", s.Hits)
+	}
+	if s.Misses != 1 {
+		t.Fatalf("unexpected Misses; got %d; want 1", s.Misses)
+	}
+	if s.CollisionChains != 1 {
+		t.Fatalf("unexpected CollisionChains; got %d; want 1", s.CollisionChains)
+	}
+	if s.MaxCollisionChain != 2 {
+		t.Fatalf("unexpected MaxCollisionChain; got %d; want 2", s.MaxCollisionChain)
+	}
+	if s.BucketStats != nil {
+		t.Fatalf("unexpected BucketStats without Options.BucketStats; got %d buckets", len(s.BucketStats))
+	}
+}
+
+func TestStorageBucketStats(t *testing.T) {
+	c := NewWithOptions(Options{BucketsCount: 4, BucketStats: true})
+	defer c.Reset()
+
+	const itemsCount = 1000
+	for i := 0; i < itemsCount; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		c.Set(k, k)
+		c.Get(nil, k)
+	}
+
+	var s Stats
+	c.UpdateStats(&s)
+	if len(s.BucketStats) != 4 {
+		t.Fatalf("unexpected number of BucketStats; got %d; want 4", len(s.BucketStats))
+	}
+	var total BucketStats
+	for _, bs := range s.BucketStats {
+		if bs.EntriesCount == 0 {
+			t.Fatalf("unexpected empty bucket among %d entries", itemsCount)
+		}
+		total.GetCalls += bs.GetCalls
+		total.SetCalls += bs.SetCalls
+		total.EntriesCount += bs.EntriesCount
+		total.BytesSize += bs.BytesSize
+	}
+	if total.GetCalls != s.GetCalls || total.SetCalls != s.SetCalls {
+		t.Fatalf("unexpected calls of buckets; got %d, %d; want %d, %d", total.GetCalls, total.SetCalls, s.GetCalls, s.SetCalls)
+	}
+	if total.EntriesCount != s.EntriesCount {
+		t.Fatalf("unexpected EntriesCount of buckets; got %d; want %d", total.EntriesCount, s.EntriesCount)
+	}
+	if total.BytesSize != s.BytesSize {
+		t.Fatalf("unexpected BytesSize of buckets; got %d; want %d", total.BytesSize, s.BytesSize)
+	}
+
+	// Wait for the lock held by the test.
+	k := keysForBucket(c, 0, 1)[0]
+	b := &c.buckets[0]
+	b.mu.Lock()
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		close(started)
+		c.Set(k, k)
+		close(done)
+	}()
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	b.mu.Unlock()
+	<-done
+
+	s.Reset()
+	c.UpdateStats(&s)
+	if len(s.BucketStats) != 4 {
+		t.Fatalf("unexpected number of BucketStats after Reset; got %d; want 4", len(s.BucketStats))
+	}
+	if s.BucketStats[0].LockWait <= 0 {
+		t.Fatalf("unexpected LockWait of the locked bucket; got %s", s.BucketStats[0].LockWait)
+	}
+	if w := s.BucketStats[1].LockWait; w >= 50*time.Millisecond {
+		t.Fatalf("unexpected LockWait of the unlocked bucket; got %s", w)
+	}
+}
+
 // func TestXXH3Collision(t *testing.T) {
 
 // 	hashes := make(map[uint64]struct{})
@@ -1429,3 +1596,56 @@ func TestStorageResetUpdateStatsSetConcurrent(t *testing.T) {
 	statsWG.Wait()
 	resettersWG.Wait()
 }
+
+func TestStorageHash(t *testing.T) {
+	c := New()
+	defer c.Reset()
+
+	// Hashes computed by the storage hasher are interchangeable with Set/Get.
+	k := []byte("key")
+	c.SetHash(k, []byte("value"), c.hasher.Hash(k))
+	if v := c.Get(nil, k); string(v) != "value" {
+		t.Fatalf("unexpected value obtained; got %q; want %q", v, "value")
+	}
+	c.Set([]byte("aaa"), []byte("bbb"))
+	if v := c.GetHash(nil, []byte("aaa"), c.hasher.Hash([]byte("aaa"))); string(v) != "bbb" {
+		t.Fatalf("unexpected value obtained; got %q; want %q", v, "bbb")
+	}
+
+	// Keys sharing the same hash are told apart.
+	c.SetHash([]byte("foo"), []byte("bar"), brokenHash)
+	c.SetHash([]byte("bar"), []byte("baz"), brokenHash)
+	if v, ok := c.HasGetHash(nil, []byte("foo"), brokenHash); !ok || string(v) != "bar" {
+		t.Fatalf("unexpected value obtained; got %q, %v; want %q, %v", v, ok, "bar", true)
+	}
+	if v, ok := c.HasGetHash(nil, []byte("baz"), brokenHash); ok || len(v) != 0 {
+		t.Fatalf("unexpected value obtained for missing key; got %q, %v", v, ok)
+	}
+
+	// Wrong hash never returns a value of another key.
+	if v, ok := c.HasGetHash(nil, []byte("foo"), brokenHash2); ok || len(v) != 0 {
+		t.Fatalf("unexpected value obtained for wrong hash; got %q, %v", v, ok)
+	}
+	if c.HasHash([]byte("foo"), c.hasher.Hash([]byte("foo"))) {
+		t.Fatalf("unexpected key %q found by wrong hash", "foo")
+	}
+	c.SetHash([]byte("other"), []byte("value"), brokenHash2)
+	if v := c.GetHash(nil, []byte("foo"), brokenHash2); len(v) != 0 {
+		t.Fatalf("unexpected value obtained for wrong hash; got %q", v)
+	}
+	c.DelHash([]byte("foo"), brokenHash2)
+	if !c.HasHash([]byte("foo"), brokenHash) || !c.HasHash([]byte("other"), brokenHash2) {
+		t.Fatalf("keys must survive Del with wrong hash")
+	}
+
+	c.DelHash([]byte("foo"), brokenHash)
+	if c.HasHash([]byte("foo"), brokenHash) {
+		t.Fatalf("unexpected deleted key %q", "foo")
+	}
+	if v := c.GetHash(nil, []byte("bar"), brokenHash); string(v) != "baz" {
+		t.Fatalf("unexpected value obtained; got %q; want %q", v, "baz")
+	}
+	if n := c.EntriesCount(); n != 4 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, 4)
+	}
+}
@@ -375,6 +375,154 @@ func BenchmarkBytestorageSetGet(b *testing.B) {
 	})
 }
 
+// Hashers
+
+func BenchmarkBytestorageHasherSet(b *testing.B) {
+	for name, hasher := range benchHashers() {
+		b.Run(name, func(b *testing.B) {
+			const items = 1 << 16
+			s := NewWithOptions(Options{Hasher: hasher})
+			defer s.Reset()
+			b.ReportAllocs()
+			b.SetBytes(items)
+			b.RunParallel(func(pb *testing.PB) {
+				k := []byte("\x00\x00\x00\x00")
+				v := []byte("xyza")
+				for pb.Next() {
+					for i := 0; i < items; i++ {
+						k[0]++
+						if k[0] == 0 {
+							k[1]++
+						}
+						s.Set(k, v)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkBytestorageHasherGet(b *testing.B) {
+	for name, hasher := range benchHashers() {
+		b.Run(name, func(b *testing.B) {
+			const items = 1 << 16
+			s := NewWithOptions(Options{Hasher: hasher})
+			defer s.Reset()
+			k := []byte("\x00\x00\x00\x00")
+			v := []byte("xyza")
+			for i := 0; i < items; i++ {
+				k[0]++
+				if k[0] == 0 {
+					k[1]++
+				}
+				s.Set(k, v)
+			}
+
+			b.ReportAllocs()
+			b.SetBytes(items)
+			b.RunParallel(func(pb *testing.PB) {
+				var buf []byte
+				k := []byte("\x00\x00\x00\x00")
+				for pb.Next() {
+					for i := 0; i < items; i++ {
+						k[0]++
+						if k[0] == 0 {
+							k[1]++
+						}
+						buf = s.Get(buf[:0], k)
+						if string(buf) != string(v) {
+							panic(fmt.Errorf("BUG: invalid value obtained; got %q; want %q", buf, v))
+						}
+					}
+				}
+			})
+		})
+	}
+}
+
+func benchHashers() map[string]Hasher {
+	return map[string]Hasher{
+		"xxh3":        XXH3Hasher{},
+		"seeded_xxh3": SeededXXH3Hasher{Seed: uint64(time.Now().UnixNano())},
+		"xxhash":      XXHashHasher{},
+		"maphash":     NewMapHasher(),
+		"func":        HasherFunc(xxh3.Hash),
+	}
+}
+
+// Batches
+
+func BenchmarkBytestorageBatchSet(b *testing.B) {
+	for _, batchSize := range []int{16, 64} {
+		keys, values := benchBatchKeys(batchSize)
+		b.Run(fmt.Sprintf("loop_%d", batchSize), func(b *testing.B) {
+			s := New()
+			defer s.Reset()
+			b.ReportAllocs()
+			b.SetBytes(int64(batchSize))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					for i := range keys {
+						s.Set(keys[i], values[i])
+					}
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("many_%d", batchSize), func(b *testing.B) {
+			s := New()
+			defer s.Reset()
+			b.ReportAllocs()
+			b.SetBytes(int64(batchSize))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s.SetMany(keys, values)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkBytestorageBatchGet(b *testing.B) {
+	for _, batchSize := range []int{16, 64} {
+		keys, values := benchBatchKeys(batchSize)
+		s := New()
+		s.SetMany(keys, values)
+		b.Run(fmt.Sprintf("loop_%d", batchSize), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(batchSize))
+			b.RunParallel(func(pb *testing.PB) {
+				dst := make([][]byte, len(keys))
+				for pb.Next() {
+					for i, k := range keys {
+						dst[i] = s.Get(dst[i][:0], k)
+					}
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("many_%d", batchSize), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(batchSize))
+			b.RunParallel(func(pb *testing.PB) {
+				var dst [][]byte
+				for pb.Next() {
+					dst = s.GetMany(dst, keys)
+				}
+			})
+		})
+		s.Reset()
+	}
+}
+
+// benchBatchKeys returns n keys with values.
+func benchBatchKeys(n int) ([][]byte, [][]byte) {
+	var keys, values [][]byte
+	for i := 0; i < n; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key %d", i)))
+		values = append(values, []byte("xyza"))
+	}
+	return keys, values
+}
+
 // Standart map
 
 func BenchmarkStdMapSet(b *testing.B) {
@@ -0,0 +1,57 @@
+package bytestorage
+
+import "unsafe"
+
+// SetString works identically to Set, but accepts string key k.
+//
+// k isn't converted to []byte, so the call doesn't allocate memory
+// if the entry is replaced with a value of the same size.
+func (s *Storage) SetString(k string, v []byte) {
+	kb := stringBytes(k)
+	h := s.hasher.Hash(kb)
+	idx := h & s.mask
+	s.buckets[idx].set(kb, v, h)
+}
+
+// GetString works identically to Get, but accepts string key k.
+//
+// The call doesn't allocate memory if dst has enough capacity.
+func (s *Storage) GetString(dst []byte, k string) []byte {
+	kb := stringBytes(k)
+	h := s.hasher.Hash(kb)
+	idx := h & s.mask
+	dst, _ = s.buckets[idx].get(dst, kb, h)
+	return dst
+}
+
+// HasGetString works identically to HasGet, but accepts string key k.
+func (s *Storage) HasGetString(dst []byte, k string) ([]byte, bool) {
+	kb := stringBytes(k)
+	h := s.hasher.Hash(kb)
+	idx := h & s.mask
+	return s.buckets[idx].get(dst, kb, h)
+}
+
+// HasString works identically to Has, but accepts string key k.
+func (s *Storage) HasString(k string) bool {
+	kb := stringBytes(k)
+	h := s.hasher.Hash(kb)
+	idx := h & s.mask
+	return s.buckets[idx].has(kb, h)
+}
+
+// DelString works identically to Del, but accepts string key k.
+func (s *Storage) DelString(k string) {
+	kb := stringBytes(k)
+	h := s.hasher.Hash(kb)
+	idx := h & s.mask
+	s.buckets[idx].del(kb, h)
+}
+
+// stringBytes returns s memory as []byte without copying.
+//
+// The result must not be modified. It may be passed to bucket methods,
+// since they copy keys before storing them.
+func stringBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
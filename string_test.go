@@ -0,0 +1,86 @@
+package bytestorage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStorageString(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	for i := 0; i < 100; i++ {
+		s.SetString(fmt.Sprintf("key %d", i), []byte(fmt.Sprintf("value %d", i)))
+	}
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key %d", i)
+		want := fmt.Sprintf("value %d", i)
+		// String and []byte keys are interchangeable.
+		if v := s.Get(nil, []byte(k)); string(v) != want {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, want)
+		}
+		if v := s.GetString(nil, k); string(v) != want {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, want)
+		}
+		if v, ok := s.HasGetString(nil, k); !ok || string(v) != want {
+			t.Fatalf("unexpected value for key %q; got %q, %v; want %q, %v", k, v, ok, want, true)
+		}
+		if !s.HasString(k) {
+			t.Fatalf("missing key %q", k)
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		s.DelString(fmt.Sprintf("key %d", i))
+	}
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key %d", i)
+		if s.HasString(k) != (i%2 != 0) {
+			t.Fatalf("unexpected existence of key %q; got %v; want %v", k, s.HasString(k), i%2 != 0)
+		}
+	}
+	if _, ok := s.HasGetString(nil, "key 0"); ok {
+		t.Fatalf("unexpected deleted key %q", "key 0")
+	}
+
+	// Stored key doesn't reference the string memory.
+	kb := []byte("mutable key")
+	s.SetString(string(kb), []byte("value"))
+	kb[0] = 'M'
+	if !s.HasString("mutable key") {
+		t.Fatalf("missing key %q", "mutable key")
+	}
+	checkBuckets(t, s)
+}
+
+func TestStorageStringAllocs(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	const k = "key"
+	v := []byte("value")
+	s.SetString(k, v)
+	dst := make([]byte, 0, 16)
+	allocs := testing.AllocsPerRun(100, func() {
+		s.SetString(k, v)
+		dst = s.GetString(dst[:0], k)
+		if _, ok := s.HasGetString(dst[:0], k); !ok {
+			panic(fmt.Errorf("BUG: missing key %q", k))
+		}
+		if !s.HasString(k) {
+			panic(fmt.Errorf("BUG: missing key %q", k))
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("unexpected allocations; got %v; want %v", allocs, 0)
+	}
+	allocs = testing.AllocsPerRun(100, func() {
+		s.DelString(k)
+		s.DelString("missing")
+	})
+	if allocs != 0 {
+		t.Fatalf("unexpected allocations for DelString; got %v; want %v", allocs, 0)
+	}
+	if string(dst) != "value" {
+		t.Fatalf("unexpected value; got %q; want %q", dst, "value")
+	}
+}
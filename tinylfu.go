@@ -0,0 +1,184 @@
+package bytestorage
+
+const (
+	// Number of rows in the count-min sketch.
+	sketchDepth = 4
+
+	// Number of counters in a sketch row per bucket entry. Sketch is reset
+	// after sampleFactor*width increments, so it sees much more distinct keys
+	// than the bucket holds. Wide rows keep the overestimation low.
+	sketchWidthFactor = 8
+
+	// Bounds for the number of counters in a sketch row.
+	minSketchWidth = 16
+	maxSketchWidth = 1 << 20
+
+	// Maximum value of a sketch counter. Counters are saturated
+	// at 4 bits like in the original TinyLFU.
+	maxSketchCount = 15
+
+	// Sketch counters are halved after sampleFactor*width increments.
+	sampleFactor = 10
+
+	// Share of bucket entries kept in the admission window, in percents.
+	windowPercent = 1
+)
+
+// sketch is a count-min sketch estimating access frequency of keys.
+//
+// It is indexed by the key hash already computed for the bucket lookup.
+type sketch struct {
+	counters  []uint8
+	width     uint64
+	additions uint64
+}
+
+func newSketch(width uint64) *sketch {
+	return &sketch{
+		counters: make([]uint8, sketchDepth*width),
+		width:    width,
+	}
+}
+
+// index returns the position of h counter in the row i.
+func (s *sketch) index(h uint64, i uint64) uint64 {
+	// The lowest bits of h select the bucket, so they are the same for all
+	// the keys in the sketch. Their number depends on Options.BucketsCount,
+	// so remix h for spreading the rest over all the bits used for
+	// double hashing.
+	h ^= h >> 32
+	h *= 0x9e3779b97f4a7c15
+	h1 := h >> 32
+	h2 := h&0xffffffff | 1
+	return i*s.width + (h1+i*h2)&(s.width-1)
+}
+
+// add increments h counters and ages the sketch periodically,
+// so the old popular keys don't stay forever.
+func (s *sketch) add(h uint64) {
+	added := false
+	for i := uint64(0); i < sketchDepth; i++ {
+		c := &s.counters[s.index(h, i)]
+		if *c < maxSketchCount {
+			*c++
+			added = true
+		}
+	}
+	if !added {
+		return
+	}
+	s.additions++
+	if s.additions >= sampleFactor*s.width {
+		for i := range s.counters {
+			s.counters[i] >>= 1
+		}
+		s.additions /= 2
+	}
+}
+
+// estimate returns the access frequency of h.
+func (s *sketch) estimate(h uint64) uint8 {
+	n := uint8(maxSketchCount)
+	for i := uint64(0); i < sketchDepth; i++ {
+		if c := s.counters[s.index(h, i)]; c < n {
+			n = c
+		}
+	}
+	return n
+}
+
+// sketchWidth returns the number of counters in a sketch row
+// for the bucket limits.
+func (ev *evictor) sketchWidth() uint64 {
+	n := ev.maxEntries
+	if n == 0 {
+		// Only the size is limited, so assume small entries.
+		n = ev.maxBytes / 64
+	}
+	n *= sketchWidthFactor
+	w := uint64(minSketchWidth)
+	for w < n && w < maxSketchWidth {
+		w <<= 1
+	}
+	return w
+}
+
+// record counts an access to the key with hash h.
+//
+// May be called under the bucket read lock.
+func (ev *evictor) record(h uint64) {
+	if ev.sketch == nil {
+		return
+	}
+	ev.mu.Lock()
+	ev.sketch.add(h)
+	ev.mu.Unlock()
+}
+
+// promote moves kv[idx] from the window to the main space.
+func (ev *evictor) promote(idx uint64) {
+	ev.window.unlink(idx)
+	ev.windowed[idx] = false
+	ev.admit(idx)
+}
+
+// evictTinyLFU keeps the window within its size and removes entries
+// until the bucket fits its limits.
+//
+// The oldest window entry is promoted to the main space for free while
+// the bucket isn't full. Otherwise it competes with the main space victim
+// and the less frequently used one is evicted.
+//
+// Must be called under the bucket write lock.
+func (b *bucket) evictTinyLFU(keep uint64) {
+	for {
+		overflow := b.overflow()
+		if b.ev.window.len > b.windowSize() {
+			cand := b.ev.window.last(keep)
+			if !overflow {
+				b.ev.promote(cand)
+				continue
+			}
+			victim, ok := b.victim(keep)
+			if ok && b.ev.sketch.estimate(b.slots[cand].h) > b.ev.sketch.estimate(b.slots[victim].h) {
+				b.evictEntry(victim)
+				b.ev.promote(cand)
+			} else {
+				b.evictEntry(cand)
+			}
+			continue
+		}
+		if !overflow {
+			return
+		}
+		idx, ok := b.victim(keep)
+		if !ok {
+			// The main space is empty.
+			if idx = b.ev.window.last(keep); idx == noIdx {
+				return
+			}
+		}
+		b.evictEntry(idx)
+	}
+}
+
+// windowSize returns the maximum number of entries in the window.
+func (b *bucket) windowSize() uint64 {
+	if n := b.entries * windowPercent / 100; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// evictEntry removes kv[idx] and counts it as evicted.
+//
+// Eviction is logged as deletion, since replay may evict other entries:
+// the eviction order depends on reads, which aren't logged, and on
+// the number of buckets in the replayed storage.
+func (b *bucket) evictEntry(idx uint64) {
+	if b.wal != nil {
+		b.wal.append(walDel, b.slots[idx].h, 0, b.kv[idx][0], nil)
+	}
+	b.remove(idx, ReasonEvicted)
+	b.ev.evictions.Add(1)
+}
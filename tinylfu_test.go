@@ -0,0 +1,115 @@
+package bytestorage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSketch(t *testing.T) {
+	s := newSketch(minSketchWidth)
+	const h = 0xdeadbeefcafebabe
+	for i := 0; i < 5; i++ {
+		s.add(h)
+	}
+	if n := s.estimate(h); n != 5 {
+		t.Fatalf("unexpected estimate; got %d; want %d", n, 5)
+	}
+	for i := 0; i < 100; i++ {
+		s.add(h)
+	}
+	if n := s.estimate(h); n != maxSketchCount {
+		t.Fatalf("counter must be saturated; got %d; want %d", n, maxSketchCount)
+	}
+
+	// Other keys age the counters of h.
+	for i := uint64(0); i < sampleFactor*minSketchWidth; i++ {
+		s.add(i << 32)
+	}
+	if n := s.estimate(h); n >= maxSketchCount {
+		t.Fatalf("counter must be aged; got %d", n)
+	}
+}
+
+func TestSketchIndexBucketBits(t *testing.T) {
+	// Keys of a bucket share the lowest bits of hash, up to 24 bits
+	// with the maximum Options.BucketsCount.
+	const width = 1024
+	s := newSketch(width)
+	for i := uint64(0); i < sketchDepth; i++ {
+		seen := make(map[uint64]bool)
+		for j := uint64(0); j < width; j++ {
+			seen[s.index(j<<24|0xabcdef, i)] = true
+		}
+		if len(seen) < width/2 {
+			t.Fatalf("row %d: keys of a bucket share too few counters; got %d; want at least %d", i, len(seen), width/2)
+		}
+	}
+}
+
+func TestBoundedTinyLFU(t *testing.T) {
+	for _, policy := range evictionPolicies {
+		t.Run(fmt.Sprintf("policy_%d", policy), func(t *testing.T) {
+			const maxEntries = 10 * bucketsCount
+			s := NewBounded(Limits{MaxEntries: maxEntries, Policy: policy, TinyLFU: true})
+			defer s.Reset()
+
+			for i := 0; i < 100000; i++ {
+				k := []byte(fmt.Sprintf("key %d", i))
+				s.Set(k, k)
+				if i%10 == 0 {
+					s.Del(k)
+				}
+			}
+			checkBuckets(t, s)
+			if n := s.EntriesCount(); n > maxEntries {
+				t.Fatalf("too many entries; got %d; want at most %d", n, maxEntries)
+			}
+			for i := range s.buckets {
+				b := &s.buckets[i]
+				var windowed uint64
+				for _, w := range b.ev.windowed {
+					if w {
+						windowed++
+					}
+				}
+				if windowed != b.ev.window.len || windowed > b.windowSize() {
+					t.Fatalf("bucket %d: unexpected window size; got %d; want %d at most %d", i, windowed, b.ev.window.len, b.windowSize())
+				}
+			}
+		})
+	}
+}
+
+func TestBoundedTinyLFUScan(t *testing.T) {
+	for _, policy := range evictionPolicies {
+		t.Run(fmt.Sprintf("policy_%d", policy), func(t *testing.T) {
+			const hotCount = 5 * bucketsCount
+			s := NewBounded(Limits{MaxEntries: 20 * bucketsCount, Policy: policy, TinyLFU: true})
+			defer s.Reset()
+
+			for i := 0; i < hotCount; i++ {
+				k := []byte(fmt.Sprintf("hot %d", i))
+				s.Set(k, k)
+				for j := 0; j < 5; j++ {
+					s.Get(nil, k)
+				}
+			}
+			// Scan of keys used only once must not flush the hot keys.
+			for i := 0; i < 100000; i++ {
+				k := []byte(fmt.Sprintf("scan %d", i))
+				s.Set(k, k)
+			}
+			checkBuckets(t, s)
+
+			var hits int
+			for i := 0; i < hotCount; i++ {
+				if s.Has([]byte(fmt.Sprintf("hot %d", i))) {
+					hits++
+				}
+			}
+			if hits < hotCount*9/10 {
+				t.Fatalf("too many hot keys evicted; got %d hits; want at least %d", hits, hotCount*9/10)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package bytestorage
+
+import (
+	"time"
+)
+
+// Number of kv entries checked in each bucket per sweep.
+const sweepSize = 1024
+
+// SetWithTTL stores (k, v) in the storage for the given ttl.
+//
+// The entry is treated as missing after ttl passes and its memory is
+// reclaimed by the background sweeper started with StartExpiration.
+// Non-positive ttl means the entry never expires, like with Set.
+func (s *Storage) SetWithTTL(k, v []byte, ttl time.Duration) {
+	var expire int64
+	if ttl > 0 {
+		expire = time.Now().Add(ttl).UnixNano()
+	}
+	h := s.hasher.Hash(k)
+	idx := h & s.mask
+	s.buckets[idx].put(k, v, h, expire)
+}
+
+// TTL returns the remaining time to live for the given key k and
+// whether the key exists in the storage.
+//
+// Zero duration is returned for existing keys without expiration.
+func (s *Storage) TTL(k []byte) (time.Duration, bool) {
+	h := s.hasher.Hash(k)
+	idx := h & s.mask
+	return s.buckets[idx].ttl(k, h)
+}
+
+// StartExpiration starts a goroutine removing expired entries from
+// the storage every interval. Call the returned function to stop it.
+//
+// Every run checks a limited number of entries in each bucket under
+// its lock, so big buckets are cleaned up over several runs without
+// blocking other operations for long.
+func (s *Storage) StartExpiration(interval time.Duration) (stop func()) {
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-t.C:
+				s.sweep(sweepSize)
+			}
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-doneCh
+	}
+}
+
+// sweep removes expired entries among the next n kv entries of every bucket.
+func (s *Storage) sweep(n int) {
+	for i := range s.buckets {
+		s.buckets[i].sweep(time.Now().UnixNano(), n)
+	}
+}
+
+func (b *bucket) ttl(k []byte, h uint64) (time.Duration, bool) {
+	b.getCalls.Add(1)
+	b.rlock()
+	defer b.mu.RUnlock()
+	idx, found := b.find(k, h)
+	if !found || b.expired(idx) {
+		b.misses.Add(1)
+		return 0, false
+	}
+	b.hits.Add(1)
+	expire := b.slots[idx].expire
+	if expire == 0 {
+		return 0, true
+	}
+	return time.Duration(expire - time.Now().UnixNano()), true
+}
+
+// sweep checks up to n kv entries starting from b.sweepPos
+// and removes expired ones.
+func (b *bucket) sweep(now int64, n int) {
+	b.lock()
+	for i := 0; i < n && b.ttls > 0; i++ {
+		if b.sweepPos >= b.offset {
+			b.sweepPos = 0
+		}
+		idx := b.sweepPos
+		b.sweepPos++
+		if expire := b.slots[idx].expire; expire != 0 && expire <= now {
+			b.remove(idx, ReasonExpired)
+		}
+	}
+	b.unlock()
+}
+
+// expired returns true if kv[idx] has expired.
+//
+// Must be called under the bucket lock.
+func (b *bucket) expired(idx uint64) bool {
+	expire := b.slots[idx].expire
+	return expire != 0 && expire <= time.Now().UnixNano()
+}
+
+// setExpire sets expiration deadline for kv[idx].
+//
+// Must be called under the bucket write lock.
+func (b *bucket) setExpire(idx uint64, expire int64) {
+	if old := b.slots[idx].expire; old == 0 && expire != 0 {
+		b.ttls++
+	} else if old != 0 && expire == 0 {
+		b.ttls--
+	}
+	b.slots[idx].expire = expire
+}
@@ -0,0 +1,184 @@
+package bytestorage
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorageSetWithTTL(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	s.SetWithTTL(k, []byte("value"), 50*time.Millisecond)
+	if v, exist := s.HasGet(nil, k); !exist || string(v) != "value" {
+		t.Fatalf("unexpected value obtained; got %q; want %q", v, "value")
+	}
+	if ttl, exist := s.TTL(k); !exist || ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Fatalf("unexpected ttl obtained; got %s, %v", ttl, exist)
+	}
+
+	// Entry without ttl.
+	s.Set([]byte("persistent"), []byte("value"))
+	if ttl, exist := s.TTL([]byte("persistent")); !exist || ttl != 0 {
+		t.Fatalf("unexpected ttl obtained; got %s, %v; want 0, true", ttl, exist)
+	}
+	if _, exist := s.TTL([]byte("missing")); exist {
+		t.Fatalf("unexpected ttl obtained for missing key")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if v, exist := s.HasGet(nil, k); exist || len(v) != 0 {
+		t.Fatalf("unexpected value obtained for expired key; got %q", v)
+	}
+	if s.Has(k) {
+		t.Fatalf("unexpected expired key %q", k)
+	}
+	if _, exist := s.TTL(k); exist {
+		t.Fatalf("unexpected ttl obtained for expired key")
+	}
+
+	// Expired entry occupies memory until swept.
+	if n := s.EntriesCount(); n != 2 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, 2)
+	}
+	s.sweep(sweepSize)
+	if n := s.EntriesCount(); n != 1 {
+		t.Fatalf("unexpected entries count after sweep; got %d; want %d", n, 1)
+	}
+	if size := s.Size(); size != uint64(len("persistent")+len("value")) {
+		t.Fatalf("unexpected size after sweep; got %d; want %d", size, len("persistent")+len("value"))
+	}
+	if v := s.Get(nil, []byte("persistent")); string(v) != "value" {
+		t.Fatalf("unexpected value obtained; got %q; want %q", v, "value")
+	}
+}
+
+func TestStorageSetWithTTLReplace(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	s.SetWithTTL(k, []byte("value"), 20*time.Millisecond)
+	// Set removes the deadline even if the value is the same.
+	s.Set(k, []byte("value"))
+	time.Sleep(30 * time.Millisecond)
+	if v := s.Get(nil, k); string(v) != "value" {
+		t.Fatalf("unexpected value obtained; got %q; want %q", v, "value")
+	}
+
+	// Expired entry is replaced by a new one.
+	s.SetWithTTL(k, []byte("value 1"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	s.SetWithTTL(k, []byte("value 2"), time.Hour)
+	if v := s.Get(nil, k); string(v) != "value 2" {
+		t.Fatalf("unexpected value obtained; got %q; want %q", v, "value 2")
+	}
+	s.sweep(sweepSize)
+	if n := s.EntriesCount(); n != 1 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, 1)
+	}
+
+	// Non-positive ttl works like Set.
+	s.SetWithTTL(k, []byte("value 3"), 0)
+	if ttl, exist := s.TTL(k); !exist || ttl != 0 {
+		t.Fatalf("unexpected ttl obtained; got %s, %v; want 0, true", ttl, exist)
+	}
+}
+
+func TestStorageTTLCollision(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	b := &s.buckets[brokenHash%bucketsCount]
+	expire := time.Now().Add(20 * time.Millisecond).UnixNano()
+	b.put([]byte("aaa"), []byte("bbb"), brokenHash, expire)
+	b.put([]byte("bbb"), []byte("ccc"), brokenHash, 0)
+	b.put([]byte("ccc"), []byte("ddd"), brokenHash, expire)
+	time.Sleep(30 * time.Millisecond)
+
+	if s.colHas([]byte("aaa"), brokenHash) || s.colHas([]byte("ccc"), brokenHash) {
+		t.Fatalf("unexpected expired keys")
+	}
+	s.sweep(sweepSize)
+	if n := s.EntriesCount(); n != 1 {
+		t.Fatalf("unexpected entries count after sweep; got %d; want %d", n, 1)
+	}
+	if v := s.colGet(nil, []byte("bbb"), brokenHash); string(v) != "ccc" {
+		t.Fatalf("unexpected value obtained; got %q; want %q", v, "ccc")
+	}
+	if len(b.col) != 0 || b.m[brokenHash] != 1 {
+		t.Fatalf("collision chain must be collapsed into m; col=%v, m=%v", b.col, b.m)
+	}
+}
+
+func TestStorageStartExpiration(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	stop := s.StartExpiration(5 * time.Millisecond)
+	defer stop()
+
+	const itemsCount = 10000
+	for i := 0; i < itemsCount; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if i%2 == 0 {
+			s.SetWithTTL(k, k, 10*time.Millisecond)
+		} else {
+			s.Set(k, k)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.EntriesCount() != itemsCount/2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired entries weren't removed; entries count %d; want %d", s.EntriesCount(), itemsCount/2)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 1; i < itemsCount; i += 2 {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if v := s.Get(nil, k); string(v) != string(k) {
+			t.Fatalf("unexpected value obtained; got %q; want %q", v, k)
+		}
+	}
+}
+
+func TestStorageTTLPersistence(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	s.SetWithTTL([]byte("short"), []byte("value"), 20*time.Millisecond)
+	s.SetWithTTL([]byte("long"), []byte("value"), time.Hour)
+	s.Set([]byte("persistent"), []byte("value"))
+
+	filePath := filepath.Join(t.TempDir(), "TestStorageTTLPersistence.bytestorage")
+	if err := s.SaveToFile(filePath); err != nil {
+		t.Fatalf("SaveToFile error: %s", err)
+	}
+	var bb bytes.Buffer
+	if err := s.Snapshot(&bb); err != nil {
+		t.Fatalf("Snapshot error: %s", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	s1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	s2, err := LoadSnapshot(&bb)
+	if err != nil {
+		t.Fatalf("LoadSnapshot error: %s", err)
+	}
+	for _, s := range []*Storage{s1, s2} {
+		if n := s.EntriesCount(); n != 2 {
+			t.Fatalf("unexpected entries count; got %d; want %d", n, 2)
+		}
+		if ttl, exist := s.TTL([]byte("long")); !exist || ttl <= 0 || ttl > time.Hour {
+			t.Fatalf("unexpected ttl obtained; got %s, %v", ttl, exist)
+		}
+		if ttl, exist := s.TTL([]byte("persistent")); !exist || ttl != 0 {
+			t.Fatalf("unexpected ttl obtained; got %s, %v; want 0, true", ttl, exist)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package bytestorage
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Codec converts values of type T to bytes and back.
+type Codec[T any] interface {
+	// Append appends encoded v to dst and returns the result.
+	Append(dst []byte, v T) ([]byte, error)
+
+	// Decode decodes data. It must not retain data after return.
+	Decode(data []byte) (T, error)
+}
+
+// TypedStorage stores keys of type K and values of type V
+// in the underlying Storage using codecs.
+//
+// Keys are compared by their encoded form, so kc must encode
+// equal keys to equal bytes.
+type TypedStorage[K, V any] struct {
+	s  *Storage
+	kc Codec[K]
+	vc Codec[V]
+}
+
+// NewTyped returns TypedStorage on top of s, which encodes keys
+// with kc and values with vc.
+func NewTyped[K, V any](s *Storage, kc Codec[K], vc Codec[V]) *TypedStorage[K, V] {
+	return &TypedStorage[K, V]{
+		s:  s,
+		kc: kc,
+		vc: vc,
+	}
+}
+
+// Storage returns the underlying storage.
+func (ts *TypedStorage[K, V]) Storage() *Storage {
+	return ts.s
+}
+
+// Set stores (k, v) in the storage.
+func (ts *TypedStorage[K, V]) Set(k K, v V) error {
+	buf := getTypedBuf()
+	defer putTypedBuf(buf)
+	var err error
+	if buf.k, err = ts.kc.Append(buf.k[:0], k); err != nil {
+		return fmt.Errorf("cannot encode key: %w", err)
+	}
+	if buf.v, err = ts.vc.Append(buf.v[:0], v); err != nil {
+		return fmt.Errorf("cannot encode value: %w", err)
+	}
+	ts.s.Set(buf.k, buf.v)
+	return nil
+}
+
+// Get returns the value for the given key k and whether k exists
+// in the storage.
+func (ts *TypedStorage[K, V]) Get(k K) (V, bool, error) {
+	var v V
+	buf := getTypedBuf()
+	defer putTypedBuf(buf)
+	var err error
+	if buf.k, err = ts.kc.Append(buf.k[:0], k); err != nil {
+		return v, false, fmt.Errorf("cannot encode key: %w", err)
+	}
+	var exists bool
+	buf.v, exists = ts.s.HasGet(buf.v[:0], buf.k)
+	if !exists {
+		return v, false, nil
+	}
+	if v, err = ts.vc.Decode(buf.v); err != nil {
+		return v, true, fmt.Errorf("cannot decode value: %w", err)
+	}
+	return v, true, nil
+}
+
+// Has returns true if entry for the given key k exists in the storage.
+func (ts *TypedStorage[K, V]) Has(k K) (bool, error) {
+	buf := getTypedBuf()
+	defer putTypedBuf(buf)
+	var err error
+	if buf.k, err = ts.kc.Append(buf.k[:0], k); err != nil {
+		return false, fmt.Errorf("cannot encode key: %w", err)
+	}
+	return ts.s.Has(buf.k), nil
+}
+
+// Del deletes value for the given key k from the storage.
+func (ts *TypedStorage[K, V]) Del(k K) error {
+	buf := getTypedBuf()
+	defer putTypedBuf(buf)
+	var err error
+	if buf.k, err = ts.kc.Append(buf.k[:0], k); err != nil {
+		return fmt.Errorf("cannot encode key: %w", err)
+	}
+	ts.s.Del(buf.k)
+	return nil
+}
+
+// typedBuf holds encoded key and value.
+type typedBuf struct {
+	k, v []byte
+}
+
+var typedBufPool sync.Pool
+
+func getTypedBuf() *typedBuf {
+	buf, _ := typedBufPool.Get().(*typedBuf)
+	if buf == nil {
+		buf = &typedBuf{}
+	}
+	return buf
+}
+
+func putTypedBuf(buf *typedBuf) {
+	typedBufPool.Put(buf)
+}
+
+// StringCodec stores strings as is.
+type StringCodec struct{}
+
+// Append implements Codec.
+func (StringCodec) Append(dst []byte, v string) ([]byte, error) {
+	return append(dst, v...), nil
+}
+
+// Decode implements Codec.
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+type integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// IntCodec stores integers as 8-byte big-endian values,
+// so int64 values may be changed with Storage.IncrBy.
+type IntCodec[T integer] struct{}
+
+// Append implements Codec.
+func (IntCodec[T]) Append(dst []byte, v T) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(dst, uint64(v)), nil
+}
+
+// Decode implements Codec.
+func (IntCodec[T]) Decode(data []byte) (T, error) {
+	if len(data) != counterSize {
+		return 0, fmt.Errorf("unexpected integer length; got %d bytes; want %d", len(data), counterSize)
+	}
+	u := binary.BigEndian.Uint64(data)
+	v := T(u)
+	if uint64(v) != u {
+		return 0, fmt.Errorf("value doesn't fit %T", v)
+	}
+	return v, nil
+}
+
+// BinaryCodec stores values implementing encoding.BinaryMarshaler
+// and encoding.BinaryUnmarshaler.
+//
+// PT is the pointer to T, for example BinaryCodec[time.Time, *time.Time].
+type BinaryCodec[T any, PT interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}] struct{}
+
+// Append implements Codec.
+func (BinaryCodec[T, PT]) Append(dst []byte, v T) ([]byte, error) {
+	data, err := PT(&v).MarshalBinary()
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, data...), nil
+}
+
+// Decode implements Codec.
+func (BinaryCodec[T, PT]) Decode(data []byte) (T, error) {
+	var v T
+	err := PT(&v).UnmarshalBinary(data)
+	return v, err
+}
+
+// JSONCodec stores values encoded with encoding/json.
+type JSONCodec[T any] struct{}
+
+// Append implements Codec.
+func (JSONCodec[T]) Append(dst []byte, v T) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, data...), nil
+}
+
+// Decode implements Codec.
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec stores values encoded with encoding/gob.
+//
+// Every value is encoded together with its type, so it is bigger
+// than with other codecs.
+type GobCodec[T any] struct{}
+
+// Append implements Codec.
+func (GobCodec[T]) Append(dst []byte, v T) ([]byte, error) {
+	bb := bytes.NewBuffer(dst)
+	if err := gob.NewEncoder(bb).Encode(v); err != nil {
+		return dst, err
+	}
+	return bb.Bytes(), nil
+}
+
+// Decode implements Codec.
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
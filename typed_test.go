@@ -0,0 +1,139 @@
+package bytestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+type typedPair struct {
+	Name  string
+	Count int
+}
+
+type typedValue struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func TestTypedStorage(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	ts := NewTyped[string, typedValue](s, StringCodec{}, JSONCodec[typedValue]{})
+	if ts.Storage() != s {
+		t.Fatalf("unexpected underlying storage")
+	}
+	for i := 0; i < 100; i++ {
+		v := typedValue{Name: fmt.Sprintf("name %d", i), Count: i, Tags: []string{"a", "b"}}
+		if err := ts.Set(fmt.Sprintf("key %d", i), v); err != nil {
+			t.Fatalf("Set error: %s", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key %d", i)
+		v, ok, err := ts.Get(k)
+		if err != nil || !ok {
+			t.Fatalf("unexpected Get result for key %q; got %v, %v", k, ok, err)
+		}
+		if v.Name != fmt.Sprintf("name %d", i) || v.Count != i || len(v.Tags) != 2 {
+			t.Fatalf("unexpected value for key %q; got %+v", k, v)
+		}
+	}
+	if ok, err := ts.Has("key 1"); err != nil || !ok {
+		t.Fatalf("unexpected Has result; got %v, %v; want %v, %v", ok, err, true, nil)
+	}
+	if err := ts.Del("key 1"); err != nil {
+		t.Fatalf("Del error: %s", err)
+	}
+	if v, ok, err := ts.Get("key 1"); err != nil || ok {
+		t.Fatalf("unexpected Get result for deleted key; got %+v, %v, %v", v, ok, err)
+	}
+
+	// Values are stored in the underlying storage as encoded.
+	data, _ := json.Marshal(typedValue{Name: "name 2", Count: 2, Tags: []string{"a", "b"}})
+	if v := s.Get(nil, []byte("key 2")); string(v) != string(data) {
+		t.Fatalf("unexpected encoded value; got %q; want %q", v, data)
+	}
+
+	// Decoding errors are reported.
+	s.Set([]byte("key 3"), []byte("not json"))
+	if _, ok, err := ts.Get("key 3"); err == nil || !ok {
+		t.Fatalf("expecting non-nil error for invalid value; got %v, %v", ok, err)
+	}
+	if err := NewTyped[string, func()](s, StringCodec{}, JSONCodec[func()]{}).Set("key", func() {}); err == nil {
+		t.Fatalf("expecting non-nil error for value which can't be encoded")
+	}
+}
+
+func TestTypedStorageCodecs(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	testCodec(t, s, IntCodec[int64]{}, []int64{0, -1, math.MinInt64, math.MaxInt64})
+	testCodec(t, s, IntCodec[int8]{}, []int8{0, -1, math.MinInt8, math.MaxInt8})
+	testCodec(t, s, IntCodec[uint64]{}, []uint64{0, 1, math.MaxUint64})
+	testCodec(t, s, IntCodec[uint16]{}, []uint16{0, 1, math.MaxUint16})
+	testCodec(t, s, StringCodec{}, []string{"", "foo", "\x00\xff"})
+	testCodec(t, s, JSONCodec[[3]int]{}, [][3]int{{}, {1, 2, 3}})
+	testCodec(t, s, GobCodec[typedPair]{}, []typedPair{{Name: "foo", Count: 1}})
+	tm := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	testCodec(t, s, BinaryCodec[time.Time, *time.Time]{}, []time.Time{tm})
+
+	// IntCodec values are counters.
+	ts := NewTyped[string, int64](s, StringCodec{}, IntCodec[int64]{})
+	if err := ts.Set("counter", 40); err != nil {
+		t.Fatalf("Set error: %s", err)
+	}
+	if _, err := s.IncrBy([]byte("counter"), 2); err != nil {
+		t.Fatalf("IncrBy error: %s", err)
+	}
+	if v, _, err := ts.Get("counter"); err != nil || v != 42 {
+		t.Fatalf("unexpected counter; got %d, %v; want %d, %v", v, err, 42, nil)
+	}
+
+	// Integers which don't fit the type are reported.
+	if _, err := (IntCodec[int8]{}).Decode([]byte("\x00\x00\x00\x00\x00\x00\x01\x00")); err == nil {
+		t.Fatalf("expecting non-nil error for overflowed int8")
+	}
+	if _, err := (IntCodec[int64]{}).Decode([]byte("\x01")); err == nil {
+		t.Fatalf("expecting non-nil error for short integer")
+	}
+}
+
+func testCodec[T comparable](t *testing.T, s *Storage, c Codec[T], values []T) {
+	t.Helper()
+	ts := NewTyped[T, T](s, c, c)
+	for _, v := range values {
+		if err := ts.Set(v, v); err != nil {
+			t.Fatalf("Set error for %v: %s", v, err)
+		}
+		got, ok, err := ts.Get(v)
+		if err != nil || !ok {
+			t.Fatalf("unexpected Get result for %v; got %v, %v", v, ok, err)
+		}
+		if got != v {
+			t.Fatalf("unexpected value; got %v; want %v", got, v)
+		}
+	}
+}
+
+func TestTypedStorageGetAllocs(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	ts := NewTyped[int64, int64](s, IntCodec[int64]{}, IntCodec[int64]{})
+	if err := ts.Set(1, 2); err != nil {
+		t.Fatalf("Set error: %s", err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, _, err := ts.Get(1); err != nil {
+			panic(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("unexpected allocations; got %v; want %v", allocs, 0)
+	}
+}
@@ -0,0 +1,170 @@
+package bytestorage
+
+// Op tells Storage.Update what to do with the entry.
+type Op int
+
+const (
+	// OpKeep leaves the entry unchanged.
+	OpKeep Op = iota
+
+	// OpSet stores the value returned by the callback.
+	OpSet
+
+	// OpDel deletes the entry.
+	OpDel
+)
+
+// Update atomically reads and changes the value for the given key k.
+//
+// fn is called under the bucket write lock with the current value of k
+// and whether k exists in the storage. The returned Op tells whether
+// to keep the entry, store the returned value or delete the entry.
+// The expiration deadline of an existing entry is kept on OpSet.
+//
+// old is valid only during fn call and must not be modified, but it may
+// be passed to append for building the new value. fn must be fast and
+// must not call the storage methods, since other operations on keys
+// of the same bucket are blocked until it returns. If fn panics,
+// the entry is left unchanged.
+func (s *Storage) Update(k []byte, fn func(old []byte, exists bool) ([]byte, Op)) {
+	h := s.hasher.Hash(k)
+	idx := h & s.mask
+	s.buckets[idx].update(k, h, fn)
+}
+
+func (b *bucket) update(k []byte, h uint64, fn func(old []byte, exists bool) ([]byte, Op)) {
+	b.lock()
+	// fn may panic, so the lock must be released anyway.
+	defer b.unlock()
+	b.updateLocked(k, h, fn)
+}
+
+// updateLocked is update for the caller holding the bucket write lock.
+//
+// The caller must release the lock with b.unlock.
+func (b *bucket) updateLocked(k []byte, h uint64, fn func(old []byte, exists bool) ([]byte, Op)) {
+	var old []byte
+	var expire int64
+	idx, exists := b.find(k, h)
+	if exists && b.expired(idx) {
+		exists = false
+	}
+	if exists {
+		// Limit the capacity, so append in fn doesn't overwrite
+		// memory referenced by snapshots.
+		v := b.kv[idx][1]
+		old = v[:len(v):len(v)]
+		expire = b.slots[idx].expire
+	}
+	v, op := fn(old, exists)
+	switch op {
+	case OpSet:
+		b.putLocked(k, v, h, expire)
+	case OpDel:
+		if exists {
+			b.delLocked(k, h)
+		}
+	}
+}
+
+// CompareAndSwap stores new for the given key k if k exists
+// and its value equals old. It returns true if new is stored.
+//
+// The expiration deadline of the entry is kept.
+func (s *Storage) CompareAndSwap(k, old, new []byte) (swapped bool) {
+	s.Update(k, func(v []byte, exists bool) ([]byte, Op) {
+		if !exists || string(v) != string(old) {
+			return nil, OpKeep
+		}
+		swapped = true
+		return new, OpSet
+	})
+	return swapped
+}
+
+// CompareAndDelete deletes the given key k if its value equals old.
+// It returns true if k is deleted.
+func (s *Storage) CompareAndDelete(k, old []byte) (deleted bool) {
+	s.Update(k, func(v []byte, exists bool) ([]byte, Op) {
+		if !exists || string(v) != string(old) {
+			return nil, OpKeep
+		}
+		deleted = true
+		return nil, OpDel
+	})
+	return deleted
+}
+
+// SetIfAbsent stores (k, v) if k doesn't exist in the storage.
+// It returns true if v is stored.
+func (s *Storage) SetIfAbsent(k, v []byte) (stored bool) {
+	s.Update(k, func(_ []byte, exists bool) ([]byte, Op) {
+		if exists {
+			return nil, OpKeep
+		}
+		stored = true
+		return v, OpSet
+	})
+	return stored
+}
+
+// SetIfPresent stores (k, v) if k exists in the storage.
+// It returns true if v is stored.
+//
+// The expiration deadline of the entry is kept.
+func (s *Storage) SetIfPresent(k, v []byte) (stored bool) {
+	s.Update(k, func(_ []byte, exists bool) ([]byte, Op) {
+		if !exists {
+			return nil, OpKeep
+		}
+		stored = true
+		return v, OpSet
+	})
+	return stored
+}
+
+// GetAndDelete deletes the given key k and appends its value to dst.
+// It returns the result and whether k existed in the storage.
+func (s *Storage) GetAndDelete(dst, k []byte) ([]byte, bool) {
+	var loaded bool
+	s.Update(k, func(v []byte, exists bool) ([]byte, Op) {
+		if !exists {
+			return nil, OpKeep
+		}
+		dst = append(dst, v...)
+		loaded = true
+		return nil, OpDel
+	})
+	return dst, loaded
+}
+
+// Swap stores (k, v) and appends the previous value of k to dst.
+// It returns the result and whether k existed in the storage.
+//
+// The expiration deadline of an existing entry is kept.
+func (s *Storage) Swap(dst, k, v []byte) ([]byte, bool) {
+	var loaded bool
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		dst = append(dst, old...)
+		loaded = exists
+		return v, OpSet
+	})
+	return dst, loaded
+}
+
+// GetOrSet appends the value of the given key k to dst if k exists.
+// Otherwise it stores (k, v) and appends v to dst.
+// It returns the result and whether k existed in the storage.
+func (s *Storage) GetOrSet(dst, k, v []byte) ([]byte, bool) {
+	var loaded bool
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		if exists {
+			dst = append(dst, old...)
+			loaded = true
+			return nil, OpKeep
+		}
+		dst = append(dst, v...)
+		return v, OpSet
+	})
+	return dst, loaded
+}
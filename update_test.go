@@ -0,0 +1,383 @@
+package bytestorage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStorageUpdate(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	var rr removalRecorder
+	s.OnRemove(rr.onRemove)
+
+	k := []byte("key")
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		if exists || old != nil {
+			t.Fatalf("unexpected existing value %q", old)
+		}
+		return []byte("foo"), OpKeep
+	})
+	if s.Has(k) {
+		t.Fatalf("unexpected key %q after OpKeep", k)
+	}
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		return []byte("foo"), OpSet
+	})
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		if !exists || string(old) != "foo" {
+			t.Fatalf("unexpected value; got %q, %v; want %q, %v", old, exists, "foo", true)
+		}
+		return append(old, "bar"...), OpSet
+	})
+	if v := s.Get(nil, k); string(v) != "foobar" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "foobar")
+	}
+	rr.check(t, removed{"key", "foo", ReasonReplaced})
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		return nil, OpKeep
+	})
+	if v := s.Get(nil, k); string(v) != "foobar" {
+		t.Fatalf("unexpected value after OpKeep; got %q; want %q", v, "foobar")
+	}
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		return nil, OpDel
+	})
+	if s.Has(k) {
+		t.Fatalf("unexpected key %q after OpDel", k)
+	}
+	rr.check(t, removed{"key", "foobar", ReasonDeleted})
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		return nil, OpDel
+	})
+	rr.check(t)
+
+	// Keys sharing the same hash are told apart.
+	s.colSet([]byte("aaa"), []byte("bbb"), brokenHash)
+	s.colSet([]byte("bbb"), []byte("ccc"), brokenHash)
+	s.buckets[brokenHash&s.mask].update([]byte("bbb"), brokenHash, func(old []byte, exists bool) ([]byte, Op) {
+		if string(old) != "ccc" {
+			t.Fatalf("unexpected value; got %q; want %q", old, "ccc")
+		}
+		return []byte("ddd"), OpSet
+	})
+	if v := s.colGet(nil, []byte("aaa"), brokenHash); string(v) != "bbb" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "bbb")
+	}
+	if v := s.colGet(nil, []byte("bbb"), brokenHash); string(v) != "ddd" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "ddd")
+	}
+	checkBuckets(t, s)
+}
+
+func TestStorageUpdateTTL(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	s.SetWithTTL(k, []byte("foo"), time.Hour)
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		return []byte("bar"), OpSet
+	})
+	if ttl, ok := s.TTL(k); !ok || ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("expiration deadline must be kept; got %s, %v", ttl, ok)
+	}
+
+	// Expired entry is missing for fn.
+	s.SetWithTTL(k, []byte("foo"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		if exists || old != nil {
+			t.Fatalf("unexpected expired value %q", old)
+		}
+		return []byte("bar"), OpSet
+	})
+	if ttl, ok := s.TTL(k); !ok || ttl != 0 {
+		t.Fatalf("unexpected ttl; got %s, %v; want %s, %v", ttl, ok, time.Duration(0), true)
+	}
+	if v := s.Get(nil, k); string(v) != "bar" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "bar")
+	}
+}
+
+func TestStorageUpdateSnapshot(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	v := make([]byte, 3, 16)
+	copy(v, "foo")
+	s.Set(k, v)
+	b := &s.buckets[s.hasher.Hash(k)&s.mask]
+	idx, _ := b.find(k, s.hasher.Hash(k))
+	mem := b.kv[idx][1][:cap(b.kv[idx][1])]
+	b.snapshot(nil)
+	defer b.releaseSnapshot()
+
+	// Growing the value must not touch the memory seen by the snapshot.
+	s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+		return append(old, "bar"...), OpSet
+	})
+	if string(mem[:6]) == "foobar" {
+		t.Fatalf("snapshot memory is overwritten")
+	}
+}
+
+func TestStorageUpdatePanic(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	s.Set(k, []byte("value"))
+	func() {
+		defer func() {
+			if r := recover(); r != "fn panic" {
+				t.Fatalf("unexpected panic; got %v; want %q", r, "fn panic")
+			}
+		}()
+		s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+			panic("fn panic")
+		})
+	}()
+
+	// The bucket is unlocked and the entry is left unchanged.
+	if v := s.Get(nil, k); string(v) != "value" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "value")
+	}
+	s.Set(k, []byte("new value"))
+	if v := s.Get(nil, k); string(v) != "new value" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "new value")
+	}
+}
+
+func TestStorageUpdateConcurrent(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	const workers = 8
+	const incrs = 1000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incrs; j++ {
+				k := []byte(fmt.Sprintf("counter %d", j%10))
+				s.Update(k, func(old []byte, exists bool) ([]byte, Op) {
+					var n uint64
+					if exists {
+						n = binary.BigEndian.Uint64(old)
+					}
+					return binary.BigEndian.AppendUint64(nil, n+1), OpSet
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		k := []byte(fmt.Sprintf("counter %d", i))
+		v := s.Get(nil, k)
+		if n := binary.BigEndian.Uint64(v); n != workers*incrs/10 {
+			t.Fatalf("unexpected counter %q; got %d; want %d", k, n, workers*incrs/10)
+		}
+	}
+}
+
+func TestStorageConditionalWrites(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	if s.SetIfPresent(k, []byte("foo")) || s.Has(k) {
+		t.Fatalf("SetIfPresent must not store missing key %q", k)
+	}
+	if s.CompareAndSwap(k, nil, []byte("foo")) || s.Has(k) {
+		t.Fatalf("CompareAndSwap must not store missing key %q", k)
+	}
+	if s.CompareAndDelete(k, nil) {
+		t.Fatalf("CompareAndDelete must not delete missing key %q", k)
+	}
+	if !s.SetIfAbsent(k, []byte("foo")) {
+		t.Fatalf("SetIfAbsent must store missing key %q", k)
+	}
+	if s.SetIfAbsent(k, []byte("bar")) {
+		t.Fatalf("SetIfAbsent must not store existing key %q", k)
+	}
+	if !s.SetIfPresent(k, []byte("bar")) {
+		t.Fatalf("SetIfPresent must store existing key %q", k)
+	}
+	if s.CompareAndSwap(k, []byte("foo"), []byte("baz")) {
+		t.Fatalf("CompareAndSwap must fail on value mismatch")
+	}
+	if !s.CompareAndSwap(k, []byte("bar"), []byte("baz")) {
+		t.Fatalf("CompareAndSwap must succeed on value match")
+	}
+	if v := s.Get(nil, k); string(v) != "baz" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "baz")
+	}
+	if s.CompareAndDelete(k, []byte("bar")) || !s.Has(k) {
+		t.Fatalf("CompareAndDelete must fail on value mismatch")
+	}
+	if !s.CompareAndDelete(k, []byte("baz")) || s.Has(k) {
+		t.Fatalf("CompareAndDelete must delete on value match")
+	}
+
+	// Expired entries are missing.
+	s.SetWithTTL(k, []byte("foo"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if s.SetIfPresent(k, []byte("bar")) || s.CompareAndSwap(k, []byte("foo"), []byte("bar")) {
+		t.Fatalf("expired key %q must be missing", k)
+	}
+	if !s.SetIfAbsent(k, []byte("bar")) {
+		t.Fatalf("SetIfAbsent must store expired key %q", k)
+	}
+	checkBuckets(t, s)
+}
+
+func TestStorageConditionalWritesCollision(t *testing.T) {
+	s := NewWithOptions(Options{Hasher: HasherFunc(func(k []byte) uint64 { return brokenHash })})
+	defer s.Reset()
+
+	keys := [][]byte{[]byte("aaa"), []byte("bbb"), []byte("ccc")}
+	for _, k := range keys {
+		if !s.SetIfAbsent(k, k) {
+			t.Fatalf("SetIfAbsent must store missing key %q", k)
+		}
+	}
+	if len(s.buckets[brokenHash&s.mask].col) != 1 {
+		t.Fatalf("keys must be stored in the collision map")
+	}
+	if s.CompareAndSwap(keys[1], keys[0], []byte("new")) {
+		t.Fatalf("CompareAndSwap must compare the value of the given key")
+	}
+	if !s.CompareAndSwap(keys[1], keys[1], []byte("new")) {
+		t.Fatalf("CompareAndSwap must succeed on value match")
+	}
+	if !s.SetIfPresent(keys[2], []byte("ddd")) || s.SetIfPresent([]byte("missing"), nil) {
+		t.Fatalf("unexpected SetIfPresent result")
+	}
+	if !s.CompareAndDelete(keys[0], keys[0]) {
+		t.Fatalf("CompareAndDelete must delete on value match")
+	}
+	want := map[string]string{"bbb": "new", "ccc": "ddd"}
+	for k, v := range want {
+		if got := s.Get(nil, []byte(k)); string(got) != v {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, got, v)
+		}
+	}
+	if s.Has(keys[0]) {
+		t.Fatalf("unexpected deleted key %q", keys[0])
+	}
+	checkBuckets(t, s)
+}
+
+func TestStorageSetIfAbsentConcurrent(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				k := fmt.Sprintf("key %d", j)
+				if s.SetIfAbsent([]byte(k), []byte(fmt.Sprintf("%d", n))) {
+					mu.Lock()
+					winners[k]++
+					mu.Unlock()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for j := 0; j < 100; j++ {
+		k := fmt.Sprintf("key %d", j)
+		if winners[k] != 1 {
+			t.Fatalf("unexpected number of stores for key %q; got %d; want %d", k, winners[k], 1)
+		}
+	}
+}
+
+func TestStorageGetAndDeleteSwapGetOrSet(t *testing.T) {
+	s := New()
+	defer s.Reset()
+	var rr removalRecorder
+	s.OnRemove(rr.onRemove)
+
+	k := []byte("key")
+	buf := []byte("prefix ")
+	if v, ok := s.GetAndDelete(buf, k); ok || string(v) != "prefix " {
+		t.Fatalf("unexpected result for missing key; got %q, %v", v, ok)
+	}
+	if v, ok := s.Swap(buf, k, []byte("foo")); ok || string(v) != "prefix " {
+		t.Fatalf("unexpected result for missing key; got %q, %v", v, ok)
+	}
+	if v, ok := s.Swap(buf, k, []byte("bar")); !ok || string(v) != "prefix foo" {
+		t.Fatalf("unexpected result; got %q, %v; want %q, %v", v, ok, "prefix foo", true)
+	}
+	rr.check(t, removed{"key", "foo", ReasonReplaced})
+	if v, ok := s.GetOrSet(buf, k, []byte("baz")); !ok || string(v) != "prefix bar" {
+		t.Fatalf("unexpected result; got %q, %v; want %q, %v", v, ok, "prefix bar", true)
+	}
+	if v, ok := s.GetAndDelete(buf, k); !ok || string(v) != "prefix bar" {
+		t.Fatalf("unexpected result; got %q, %v; want %q, %v", v, ok, "prefix bar", true)
+	}
+	rr.check(t, removed{"key", "bar", ReasonDeleted})
+	if s.Has(k) {
+		t.Fatalf("unexpected deleted key %q", k)
+	}
+	if v, ok := s.GetOrSet(buf, k, []byte("baz")); ok || string(v) != "prefix baz" {
+		t.Fatalf("unexpected result; got %q, %v; want %q, %v", v, ok, "prefix baz", false)
+	}
+	if v := s.Get(nil, k); string(v) != "baz" {
+		t.Fatalf("unexpected value; got %q; want %q", v, "baz")
+	}
+	checkBuckets(t, s)
+}
+
+func TestStorageGetAndDeleteConcurrent(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	const itemsCount = 1000
+	for i := 0; i < itemsCount; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		s.Set(k, k)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	drained := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf []byte
+			for j := 0; j < itemsCount; j++ {
+				k := []byte(fmt.Sprintf("key %d", j))
+				var ok bool
+				if buf, ok = s.GetAndDelete(buf[:0], k); ok {
+					if string(buf) != string(k) {
+						t.Errorf("unexpected value for key %q; got %q", k, buf)
+						return
+					}
+					mu.Lock()
+					drained++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if drained != itemsCount {
+		t.Fatalf("every key must be drained exactly once; got %d; want %d", drained, itemsCount)
+	}
+	if n := s.EntriesCount(); n != 0 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, 0)
+	}
+}
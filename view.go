@@ -0,0 +1,39 @@
+package bytestorage
+
+import "errors"
+
+// ErrNotFound is returned by View if the key doesn't exist in the storage.
+var ErrNotFound = errors.New("key not found")
+
+// View calls fn with the value for the given key k without copying it
+// and returns the error returned by fn.
+//
+// ErrNotFound is returned without calling fn if k doesn't exist.
+//
+// fn is called under the bucket read lock, so the value can't be changed
+// by concurrent writes while fn runs. v is valid only during fn call
+// and must not be modified. fn must be fast and must not call the storage
+// methods, since writes to keys of the same bucket are blocked until
+// it returns.
+func (s *Storage) View(k []byte, fn func(v []byte) error) error {
+	h := s.hasher.Hash(k)
+	idx := h & s.mask
+	return s.buckets[idx].view(k, h, fn)
+}
+
+func (b *bucket) view(k []byte, h uint64, fn func(v []byte) error) error {
+	b.getCalls.Add(1)
+	b.rlock()
+	defer b.mu.RUnlock()
+	b.ev.record(h)
+	idx, found := b.find(k, h)
+	if !found || b.expired(idx) {
+		b.misses.Add(1)
+		return ErrNotFound
+	}
+	b.hits.Add(1)
+	b.ev.touch(idx)
+	// Limit the capacity, so append in fn can't overwrite the bucket memory.
+	v := b.kv[idx][1]
+	return fn(v[:len(v):len(v)])
+}
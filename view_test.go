@@ -0,0 +1,129 @@
+package bytestorage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStorageView(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	k := []byte("key")
+	called := false
+	err := s.View(k, func(v []byte) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, ErrNotFound) || called {
+		t.Fatalf("unexpected result for missing key; got %v, called=%v; want %v", err, called, ErrNotFound)
+	}
+
+	s.Set(k, []byte("value"))
+	err = s.View(k, func(v []byte) error {
+		if string(v) != "value" {
+			t.Errorf("unexpected value; got %q; want %q", v, "value")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	errFn := errors.New("fn error")
+	if err := s.View(k, func(v []byte) error { return errFn }); err != errFn {
+		t.Fatalf("unexpected error; got %v; want %v", err, errFn)
+	}
+
+	// Expired entry is missing.
+	s.SetWithTTL(k, []byte("value"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if err := s.View(k, func(v []byte) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unexpected error for expired key; got %v; want %v", err, ErrNotFound)
+	}
+
+	// Keys sharing the same hash are told apart.
+	s.colSet([]byte("aaa"), []byte("bbb"), brokenHash)
+	s.colSet([]byte("bbb"), []byte("ccc"), brokenHash)
+	var got []byte
+	err = s.buckets[brokenHash&s.mask].view([]byte("bbb"), brokenHash, func(v []byte) error {
+		got = append(got, v...)
+		return nil
+	})
+	if err != nil || string(got) != "ccc" {
+		t.Fatalf("unexpected result; got %q, %v; want %q, %v", got, err, "ccc", nil)
+	}
+	if err := s.buckets[brokenHash&s.mask].view([]byte("ccc"), brokenHash, func(v []byte) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unexpected error for missing key; got %v; want %v", err, ErrNotFound)
+	}
+}
+
+// Run with -race: writers reuse the value memory in place,
+// so readers observe torn values if View doesn't hold the lock.
+func TestStorageViewConcurrent(t *testing.T) {
+	s := New()
+	defer s.Reset()
+
+	const keysCount = 10
+	const valueLen = 1024
+	for i := 0; i < keysCount; i++ {
+		s.Set([]byte(fmt.Sprintf("key %d", i)), bytes.Repeat([]byte{0}, valueLen))
+	}
+	stopCh := make(chan struct{})
+	var writersWG sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		writersWG.Add(1)
+		go func(n int) {
+			defer writersWG.Done()
+			v := make([]byte, valueLen)
+			for j := 0; ; j++ {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				for p := range v {
+					v[p] = byte(j + n)
+				}
+				k := []byte(fmt.Sprintf("key %d", j%keysCount))
+				if j%7 == 0 {
+					s.Update(k, func(old []byte, exists bool) ([]byte, Op) { return v, OpSet })
+				} else {
+					s.Set(k, v)
+				}
+			}
+		}(i)
+	}
+
+	var readersWG sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readersWG.Add(1)
+		go func() {
+			defer readersWG.Done()
+			for j := 0; j < 10000; j++ {
+				k := []byte(fmt.Sprintf("key %d", j%keysCount))
+				err := s.View(k, func(v []byte) error {
+					if len(v) != valueLen {
+						return fmt.Errorf("unexpected value length; got %d; want %d", len(v), valueLen)
+					}
+					for _, c := range v {
+						if c != v[0] {
+							return fmt.Errorf("torn value for key %q", k)
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	readersWG.Wait()
+	close(stopCh)
+	writersWG.Wait()
+}
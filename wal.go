@@ -0,0 +1,513 @@
+package bytestorage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zeebo/xxh3"
+)
+
+// SyncPolicy defines how often the write-ahead log is synced to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the log after every record.
+	//
+	// No acknowledged write is lost on crash, but every Set and Del
+	// waits for the disk.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval syncs the log every WALOptions.SyncInterval.
+	//
+	// Writes made during the last interval may be lost on crash.
+	SyncInterval
+
+	// SyncNever leaves syncing to the operating system.
+	//
+	// Records are buffered and written when the buffer is full,
+	// so the log is synced only by WAL.Sync and WAL.Close.
+	SyncNever
+)
+
+// Default interval for SyncInterval policy.
+const defaultSyncInterval = 100 * time.Millisecond
+
+// WALOptions contains options for OpenWAL.
+type WALOptions struct {
+	// Sync is the sync policy of the log.
+	Sync SyncPolicy
+
+	// SyncInterval is the interval between syncs for SyncInterval policy.
+	//
+	// 100ms is used if it isn't set.
+	SyncInterval time.Duration
+}
+
+// Operations recorded in the log.
+const (
+	walSet uint64 = iota + 1
+	walDel
+	walReset
+
+	// Hasher of the storage, which computed hashes of the next records.
+	// Its kind and seed are stored in the hash and expire fields.
+	walHasher
+)
+
+// WAL is an append-only write-ahead log of Set and Del calls.
+//
+// The log is a directory containing numbered segment files.
+// Typical usage on startup is:
+//
+//	s := bytestorage.LoadFromFileOrNew(snapshotPath)
+//	w, err := bytestorage.OpenWAL(walPath, opts)
+//	...
+//	if err := w.Replay(s); err != nil {
+//		...
+//	}
+//	s.AttachWAL(w)
+//
+// Call WAL.Checkpoint periodically to save the storage and truncate the log.
+type WAL struct {
+	dir  string
+	opts WALOptions
+
+	mu  sync.Mutex
+	seq uint64
+	f   *os.File
+	bw  *bufio.Writer
+	buf []byte
+
+	// Hasher of the attached storage, which is recorded
+	// at the beginning of every segment.
+	hasher *hasherID
+
+	// The first error occurred while writing the log.
+	err error
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+var walFileRegexp = regexp.MustCompile(`^wal\.(\d+)\.log$`)
+
+// OpenWAL opens the write-ahead log stored in dir.
+//
+// The dir is created if it doesn't exist. New records are written
+// to a new segment, so existing records are left as is until
+// they are truncated by WAL.Checkpoint.
+func OpenWAL(dir string, opts WALOptions) (*WAL, error) {
+	if opts.Sync == SyncInterval && opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaultSyncInterval
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create dir %q: %w", dir, err)
+	}
+	seqs, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		dir:  dir,
+		opts: opts,
+	}
+	if len(seqs) > 0 {
+		w.seq = seqs[len(seqs)-1]
+	}
+	if err := w.openSegment(w.seq + 1); err != nil {
+		return nil, err
+	}
+	if opts.Sync == SyncInterval {
+		w.stopCh = make(chan struct{})
+		w.wg.Add(1)
+		go w.syncer()
+	}
+	return w, nil
+}
+
+// AttachWAL makes s record all the subsequent Set, Del and Reset calls to w.
+//
+// Pass nil to stop recording.
+func (s *Storage) AttachWAL(w *WAL) {
+	if w != nil {
+		w.setHasher(idOf(s.hasher))
+	}
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		b.lock()
+		b.wal = w
+		b.mu.Unlock()
+	}
+	s.wal.Store(w)
+}
+
+// Replay applies all the records from w to s.
+//
+// Replay must be called before s is attached to w.
+// A partially written record at the end of a segment is ignored,
+// since it is the result of a crash during write. So is the last record
+// of a segment with checksum mismatch. Corrupted records followed by
+// other data are reported as errors.
+//
+// Keys are hashed again if s uses another seed than the storage
+// which wrote the log, for example if s is created with New because
+// no checkpoint was made yet.
+func (w *WAL) Replay(s *Storage) error {
+	seqs, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		if err := replaySegment(s, w.segmentPath(seq)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checkpoint saves s to filePath with Storage.SaveToFile and removes
+// the log records included in the saved data.
+//
+// Writes to s are not blocked during checkpoint. They go to a new
+// segment, which is kept after checkpoint.
+func (w *WAL) Checkpoint(s *Storage, filePath string) error {
+	w.mu.Lock()
+	if err := w.flush(); err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	_ = w.f.Close()
+	seq := w.seq + 1
+	err := w.openSegment(seq)
+	if err != nil {
+		// The log can't be written anymore.
+		w.err = err
+	}
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := s.SaveToFile(filePath); err != nil {
+		return err
+	}
+
+	seqs, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range seqs {
+		if n >= seq {
+			break
+		}
+		if err := os.Remove(w.segmentPath(n)); err != nil {
+			return fmt.Errorf("cannot remove log segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// Sync writes buffered records to disk.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	err := w.flush()
+	w.mu.Unlock()
+	return err
+}
+
+// Err returns the first error occurred while writing the log.
+//
+// Set and Del can't return errors, so check Err periodically.
+func (w *WAL) Err() error {
+	w.mu.Lock()
+	err := w.err
+	w.mu.Unlock()
+	return err
+}
+
+// Close syncs and closes the log.
+//
+// Storage must be detached from w before closing it.
+func (w *WAL) Close() error {
+	if w.stopCh != nil {
+		close(w.stopCh)
+		w.wg.Wait()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.flush()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *WAL) syncer() {
+	defer w.wg.Done()
+	t := time.NewTicker(w.opts.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-t.C:
+			w.mu.Lock()
+			_ = w.flush()
+			w.mu.Unlock()
+		}
+	}
+}
+
+// setHasher records the hasher of the attached storage.
+func (w *WAL) setHasher(id hasherID) {
+	w.mu.Lock()
+	w.hasher = &id
+	w.write(walHasher, id.kind, int64(id.seed), nil, nil)
+	w.mu.Unlock()
+}
+
+// append adds a record to the log.
+//
+// It is called under the bucket lock, so records for a key
+// are written in the order they are applied.
+func (w *WAL) append(op, h uint64, expire int64, k, v []byte) {
+	w.mu.Lock()
+	w.write(op, h, expire, k, v)
+	w.mu.Unlock()
+}
+
+// write must be called under w.mu.
+func (w *WAL) write(op, h uint64, expire int64, k, v []byte) {
+	if w.err != nil {
+		return
+	}
+	buf := appendUint64(w.buf[:0], op)
+	buf = appendUint64(buf, h)
+	buf = appendUint64(buf, uint64(expire))
+	buf = appendUint64(buf, uint64(len(k)))
+	buf = appendUint64(buf, uint64(len(v)))
+	buf = append(buf, k...)
+	buf = append(buf, v...)
+	buf = appendUint64(buf, xxh3.Hash(buf))
+	w.buf = buf
+	if _, err := w.bw.Write(buf); err != nil {
+		w.err = fmt.Errorf("cannot write to %q: %w", w.f.Name(), err)
+		return
+	}
+	if w.opts.Sync == SyncAlways {
+		_ = w.flush()
+	}
+}
+
+// flush writes buffered records and syncs the segment to disk.
+//
+// It must be called under w.mu.
+func (w *WAL) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.bw.Flush(); err != nil {
+		w.err = fmt.Errorf("cannot flush %q: %w", w.f.Name(), err)
+		return w.err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.err = fmt.Errorf("cannot sync %q: %w", w.f.Name(), err)
+		return w.err
+	}
+	return nil
+}
+
+// openSegment must be called under w.mu.
+func (w *WAL) openSegment(seq uint64) error {
+	path := w.segmentPath(seq)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %w", path, err)
+	}
+	w.seq = seq
+	w.f = f
+	if w.bw == nil {
+		w.bw = bufio.NewWriter(f)
+	} else {
+		w.bw.Reset(f)
+	}
+	if w.hasher != nil {
+		// Every segment may be replayed alone after checkpoint.
+		w.write(walHasher, w.hasher.kind, int64(w.hasher.seed), nil, nil)
+	}
+	return nil
+}
+
+func (w *WAL) segmentPath(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("wal.%020d.log", seq))
+}
+
+// walSegments returns sorted sequence numbers of segments in dir.
+func walSegments(dir string) ([]uint64, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read files from %q: %w", dir, err)
+	}
+	var seqs []uint64
+	for _, de := range des {
+		m := walFileRegexp.FindStringSubmatch(de.Name())
+		if de.IsDir() || m == nil {
+			continue
+		}
+		seq, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected log segment name %q: %w", de.Name(), err)
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func replaySegment(s *Storage, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", path, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat %q: %w", path, err)
+	}
+	br := bufio.NewReader(f)
+	// Every segment starts with the hasher record, which sets rehash.
+	id := idOf(s.hasher)
+	rehash := false
+	for {
+		op, e, err := readWALRecord(br, uint64(fi.Size()))
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			// Reached the end of segment or the torn record after crash.
+			return nil
+		}
+		if err == errWALChecksum {
+			// A crash may leave the last record with intact op and garbage
+			// or zeros in the rest. Every segment except for the one being
+			// written may have been the newest one at crash.
+			zero, zerr := zeroTail(br)
+			if zerr != nil {
+				return fmt.Errorf("cannot read %q: %w", path, zerr)
+			}
+			if zero {
+				return nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("cannot replay %q: %w", path, err)
+		}
+		switch op {
+		case walSet:
+			if rehash {
+				e.h = s.hasher.Hash(e.k)
+			}
+			s.buckets[e.h&s.mask].put(e.k, e.v, e.h, e.expire)
+		case walDel:
+			if rehash {
+				e.h = s.hasher.Hash(e.k)
+			}
+			s.buckets[e.h&s.mask].del(e.k, e.h)
+		case walReset:
+			s.Reset()
+		case walHasher:
+			rehash = mustRehash(hasherID{kind: e.h, seed: uint64(e.expire)}, id)
+		}
+	}
+}
+
+// zeroTail returns true if the rest of r contains only zero bytes.
+func zeroTail(r io.Reader) (bool, error) {
+	var buf [4096]byte
+	for {
+		n, err := r.Read(buf[:])
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// mustRehash returns true if hashes computed by the hasher from
+// the log must be computed again by the hasher of the storage.
+//
+// Hashes computed by custom hashers can't be checked, so they are used as is.
+// Hashes computed by MapHasher are always computed again, since its seed
+// isn't recorded.
+func mustRehash(logged, id hasherID) bool {
+	if logged.kind == hasherMap {
+		return true
+	}
+	return logged != id && logged.kind != hasherCustom && id.kind != hasherCustom
+}
+
+var errWALChecksum = errors.New("checksum mismatch")
+
+func readWALRecord(r io.Reader, maxLen uint64) (uint64, entry, error) {
+	var e entry
+	h := xxh3.New()
+	tr := io.TeeReader(r, h)
+	op, err := readUint64(tr)
+	if err != nil {
+		return 0, e, err
+	}
+	if op == 0 {
+		// Zero-filled tail left by a crash.
+		return 0, e, io.ErrUnexpectedEOF
+	}
+	if op < walSet || op > walHasher {
+		return 0, e, fmt.Errorf("unknown operation %d", op)
+	}
+	if e.h, err = readUint64(tr); err != nil {
+		return 0, e, unexpectedEOF(err)
+	}
+	expire, err := readUint64(tr)
+	if err != nil {
+		return 0, e, unexpectedEOF(err)
+	}
+	e.expire = int64(expire)
+	kLen, err := readUint64(tr)
+	if err != nil {
+		return 0, e, unexpectedEOF(err)
+	}
+	vLen, err := readUint64(tr)
+	if err != nil {
+		return 0, e, unexpectedEOF(err)
+	}
+	if kLen > maxLen || vLen > maxLen {
+		return 0, e, io.ErrUnexpectedEOF
+	}
+	kv, err := readBytes(tr, kLen+vLen)
+	if err != nil {
+		return 0, e, unexpectedEOF(err)
+	}
+	e.k, e.v = kv[:kLen:kLen], kv[kLen:]
+	sum, err := readUint64(r)
+	if err != nil {
+		return 0, e, unexpectedEOF(err)
+	}
+	if sum != h.Sum64() {
+		return 0, e, errWALChecksum
+	}
+	return op, e, nil
+}
@@ -0,0 +1,331 @@
+package bytestorage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWALReplay(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		t.Run(fmt.Sprintf("policy_%d", policy), func(t *testing.T) {
+			testWALReplay(t, WALOptions{Sync: policy, SyncInterval: time.Millisecond})
+		})
+	}
+}
+
+func testWALReplay(t *testing.T, opts WALOptions) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	w, err := OpenWAL(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	s := New()
+	s.AttachWAL(w)
+	s.Set([]byte("foo"), []byte("bar"))
+	s.Reset()
+	for i := 0; i < 1000; i++ {
+		s.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	for i := 0; i < 1000; i += 2 {
+		s.Del([]byte(fmt.Sprintf("key %d", i)))
+	}
+	s.colSet([]byte("aaa"), []byte("bbb"), brokenHash)
+	s.colSet([]byte("bbb"), []byte("ccc"), brokenHash)
+	s.colDel([]byte("aaa"), brokenHash)
+	s.SetWithTTL([]byte("ttl"), []byte("value"), time.Hour)
+	s.AttachWAL(nil)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	w, err = OpenWAL(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	defer w.Close()
+	// Keys with broken hash may be found only by the same hasher.
+	s1 := NewWithOptions(Options{Hasher: s.hasher})
+	if err := w.Replay(s1); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+	if s1.Has([]byte("foo")) {
+		t.Fatalf("unexpected key %q after reset", "foo")
+	}
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		v, exist := s1.HasGet(nil, k)
+		if i%2 == 0 {
+			if exist {
+				t.Fatalf("unexpected deleted key %q with value %q", k, v)
+			}
+			continue
+		}
+		if string(v) != fmt.Sprintf("value %d", i) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, fmt.Sprintf("value %d", i))
+		}
+	}
+	if s1.colHas([]byte("aaa"), brokenHash) {
+		t.Fatalf("unexpected deleted key %q", "aaa")
+	}
+	if v := s1.colGet(nil, []byte("bbb"), brokenHash); string(v) != "ccc" {
+		t.Fatalf("unexpected value for key %q; got %q; want %q", "bbb", v, "ccc")
+	}
+	if ttl, exist := s1.TTL([]byte("ttl")); !exist || ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("unexpected ttl obtained; got %s, %v", ttl, exist)
+	}
+	if n := s1.EntriesCount(); n != 502 {
+		t.Fatalf("unexpected entries count; got %d; want %d", n, 502)
+	}
+}
+
+func TestWALReplayRehash(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	w, err := OpenWAL(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	s := New()
+	s.AttachWAL(w)
+	for i := 0; i < 1000; i++ {
+		s.Set([]byte(fmt.Sprintf("key %d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	for i := 0; i < 1000; i += 2 {
+		s.Del([]byte(fmt.Sprintf("key %d", i)))
+	}
+	s.AttachWAL(nil)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	w, err = OpenWAL(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	defer w.Close()
+	for _, s1 := range []*Storage{New(), NewWithOptions(Options{Hasher: XXH3Hasher{}})} {
+		if idOf(s1.hasher) == idOf(s.hasher) {
+			t.Fatalf("storages must use distinct hashers")
+		}
+		if err := w.Replay(s1); err != nil {
+			t.Fatalf("Replay error: %s", err)
+		}
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("key %d", i))
+			v, exist := s1.HasGet(nil, k)
+			if exist != (i%2 != 0) {
+				t.Fatalf("unexpected existence of key %q; got %v; want %v", k, exist, i%2 != 0)
+			}
+			if exist && string(v) != fmt.Sprintf("value %d", i) {
+				t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, fmt.Sprintf("value %d", i))
+			}
+		}
+		if n := s1.EntriesCount(); n != 500 {
+			t.Fatalf("unexpected entries count; got %d; want %d", n, 500)
+		}
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	w, err := OpenWAL(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	s := New()
+	s.AttachWAL(w)
+	s.Set([]byte("aaa"), []byte("bbb"))
+	s.Set([]byte("ccc"), []byte("ddd"))
+	s.AttachWAL(nil)
+	path := w.segmentPath(w.seq)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the last record in the middle.
+	if err := os.WriteFile(path, data[:len(data)-5], 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err = OpenWAL(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	defer w.Close()
+	s1 := New()
+	if err := w.Replay(s1); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+	if v := s1.Get(nil, []byte("aaa")); string(v) != "bbb" {
+		t.Fatalf("unexpected value for key %q; got %q; want %q", "aaa", v, "bbb")
+	}
+	if s1.Has([]byte("ccc")) {
+		t.Fatalf("unexpected key %q from torn record", "ccc")
+	}
+
+	// The last record with intact op and zeroed or corrupted rest.
+	const lastLen = 5*8 + len("cccddd") + 8
+	zeroed := append([]byte{}, data...)
+	clear(zeroed[len(zeroed)-lastLen+8:])
+	garbage := append([]byte{}, data...)
+	garbage[len(garbage)-12] ^= 0xff
+	for _, torn := range [][]byte{zeroed, garbage, append(zeroed, make([]byte, 100)...)} {
+		if err := os.WriteFile(path, torn, 0644); err != nil {
+			t.Fatal(err)
+		}
+		s1 := New()
+		if err := w.Replay(s1); err != nil {
+			t.Fatalf("Replay error: %s", err)
+		}
+		if v := s1.Get(nil, []byte("aaa")); string(v) != "bbb" {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", "aaa", v, "bbb")
+		}
+		if s1.Has([]byte("ccc")) {
+			t.Fatalf("unexpected key %q from torn record", "ccc")
+		}
+	}
+
+	// Corrupted record in the middle of segment must be reported.
+	corrupted := append([]byte{}, data...)
+	corrupted[40] ^= 0xff
+	if err := os.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Replay(New()); err == nil {
+		t.Fatalf("expecting non-nil error when replaying corrupted log")
+	}
+}
+
+func TestWALResetConcurrent(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	w, err := OpenWAL(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	s := New()
+	s.AttachWAL(w)
+
+	// Writes racing with Reset must be either removed or kept in both
+	// the storage and the log, so every key is written only once.
+	const workers, keysCount = 4, 10000
+	doneCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; i < keysCount; i++ {
+				s.Set([]byte(fmt.Sprintf("key %d %d", n, i)), []byte(fmt.Sprintf("value %d", i)))
+			}
+		}(n)
+	}
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+	for stop := false; !stop; {
+		select {
+		case <-doneCh:
+			stop = true
+		default:
+			s.Reset()
+		}
+	}
+	s.AttachWAL(nil)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	w, err = OpenWAL(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	defer w.Close()
+	s1 := NewWithOptions(Options{Hasher: s.hasher})
+	if err := w.Replay(s1); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+	for n := 0; n < workers; n++ {
+		for i := 0; i < keysCount; i++ {
+			k := []byte(fmt.Sprintf("key %d %d", n, i))
+			if exist, exist1 := s.Has(k), s1.Has(k); exist1 != exist {
+				t.Fatalf("unexpected existence of key %q after replay; got %v; want %v", k, exist1, exist)
+			}
+		}
+	}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	tmpDir := t.TempDir()
+	walDir := filepath.Join(tmpDir, "wal")
+	filePath := filepath.Join(tmpDir, "data.bytestorage")
+	w, err := OpenWAL(walDir, WALOptions{Sync: SyncInterval})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	s := New()
+	s.AttachWAL(w)
+
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			s.Set([]byte(fmt.Sprintf("key %d", i%1000)), []byte(fmt.Sprintf("value %d", i)))
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if err := w.Checkpoint(s, filePath); err != nil {
+			t.Fatalf("Checkpoint error: %s", err)
+		}
+	}
+	close(stopCh)
+	wg.Wait()
+	s.Set([]byte("last"), []byte("value"))
+	s.AttachWAL(nil)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %s", err)
+	}
+
+	seqs, err := walSegments(walDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 1 {
+		t.Fatalf("unexpected number of log segments after checkpoint; got %d; want %d", len(seqs), 1)
+	}
+
+	s1, err := LoadFromFile(filePath)
+	if err != nil {
+		t.Fatalf("LoadFromFile error: %s", err)
+	}
+	w, err = OpenWAL(walDir, WALOptions{Sync: SyncInterval})
+	if err != nil {
+		t.Fatalf("OpenWAL error: %s", err)
+	}
+	defer w.Close()
+	if err := w.Replay(s1); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("key %d", i))
+		if v, want := s1.Get(nil, k), s.Get(nil, k); string(v) != string(want) {
+			t.Fatalf("unexpected value for key %q; got %q; want %q", k, v, want)
+		}
+	}
+	if v := s1.Get(nil, []byte("last")); string(v) != "value" {
+		t.Fatalf("unexpected value for key %q; got %q; want %q", "last", v, "value")
+	}
+}